@@ -1,19 +1,27 @@
 module github.com/fasmide/schttp
 
-go 1.17
+go 1.25.0
 
 require (
+	filippo.io/age v1.3.2
 	github.com/cloudflare/tableflip v1.2.2
+	github.com/dsnet/compress v0.0.1
 	github.com/fasmide/hostkeys v0.0.0-20211023164018-0a66d786b24e
+	github.com/klauspost/compress v1.20.1
+	github.com/pkg/sftp v1.13.11
 	github.com/spf13/viper v1.3.2
 	github.com/teris-io/shortid v0.0.0-20171029131806-771a37caa5cf
-	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	github.com/ulikunitz/xz v0.5.17
+	golang.org/x/crypto v0.55.0
 )
 
 require (
+	filippo.io/edwards25519 v1.2.0 // indirect
+	filippo.io/hpke v0.4.0 // indirect
 	github.com/BurntSushi/toml v0.4.1 // indirect
 	github.com/fsnotify/fsnotify v1.5.1 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 	github.com/magiconair/properties v1.8.0 // indirect
 	github.com/mitchellh/mapstructure v1.1.2 // indirect
 	github.com/pelletier/go-toml v1.2.0 // indirect
@@ -21,7 +29,7 @@ require (
 	github.com/spf13/cast v1.3.0 // indirect
 	github.com/spf13/jwalterweatherman v1.0.0 // indirect
 	github.com/spf13/pflag v1.0.3 // indirect
-	golang.org/x/sys v0.0.0-20210630005230-0f9fa26af87c // indirect
-	golang.org/x/text v0.3.3 // indirect
+	golang.org/x/sys v0.47.0 // indirect
+	golang.org/x/text v0.41.0 // indirect
 	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
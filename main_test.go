@@ -2,27 +2,44 @@ package main
 
 import (
 	"archive/tar"
+	"archive/zip"
 	"bufio"
+	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/ed25519"
 	"crypto/md5"
+	"encoding/base64"
+	"encoding/pem"
 	"fmt"
 	"io"
 	"math/rand"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"filippo.io/age"
+	"filippo.io/age/agessh"
 	"github.com/fasmide/schttp/scp"
 	"github.com/fasmide/schttp/web"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
 )
 
 // KnownTestDirectoryHash is the md5 digest of test-directory filenames and contents
-const KnownTestDirectoryHash = "3e8a7eddba29589d389dc65082f840c6"
+// - sorted by filename as the order of files depends on the filesystem they are read from
+const KnownTestDirectoryHash = "2a226730bdee00bf7b3fccf68cf3acbe"
 
 var scpPort, httpPort int
 
@@ -53,12 +70,18 @@ func TestMain(t *testing.T) {
 
 	var shutdown sync.WaitGroup
 
+	// the configuration must not change once servers are running, tests
+	// needing another configuration set up servers of their own
+	schttp.scpServer = scp.NewServer()
+	schttp.webServer = &web.Server{DB: schttp.scpServer}
+
+	// fingerprints of recipients are looked up in a directory of the recipient test
+	recipients := t.TempDir()
+	schttp.scpServer.RecipientDirectory = recipients
+
 	shutdown.Add(1)
 	go func() {
-		schttp.scpServer = scp.NewServer()
 		go schttp.scpServer.Listen(schttp.sshFd)
-
-		schttp.webServer = &web.Server{DB: schttp.scpServer}
 		go schttp.webServer.Listen(schttp.httpFd)
 
 		// wait here till we are finished testing
@@ -68,41 +91,95 @@ func TestMain(t *testing.T) {
 		schttp.webServer.Shutdown(context.TODO())
 	}()
 
-	scp := exec.Command("scp",
-		"-oStrictHostKeyChecking=no",
-		fmt.Sprintf("-P%d", scpPort),
-		"-r", "test-directory/", "127.0.0.1:",
-	)
+	// scp clients speak sftp by default, -O makes them use the original scp protocol
+	// - sftp clients set directory modes and times after their contents have been uploaded,
+	//   by then it is too late to preserve them
+	t.Run("Sink/scp", func(t *testing.T) { testSink(t, true, false, "-O", "-p") })
+	t.Run("Sink/sftp", func(t *testing.T) { testSink(t, false, false, "-p") })
+	t.Run("Spool/scp", func(t *testing.T) { testSink(t, true, true, "-O", "-p", "-oUser=spool") })
+	t.Run("Spool/sftp", func(t *testing.T) { testSink(t, false, true, "-p", "-oUser=spool") })
+	t.Run("Stored", testStored)
+	t.Run("Downloads", testDownloads)
+	t.Run("Fanout", testFanout)
+	t.Run("Options", testOptions)
+	t.Run("Password", testPassword)
+	t.Run("Recipient", func(t *testing.T) { testRecipient(t, recipients) })
+	t.Run("AuthorizedKeys", testAuthorizedKeys)
+	t.Run("Certificates", testCertificates)
+	t.Run("Progress", testProgress)
+	t.Run("Replies", testReplies)
+	t.Run("SFTPMaxSize", testSFTPMaxSize)
+	t.Run("Keepalive", testKeepalive)
+	t.Run("Raw/scp", func(t *testing.T) { testRaw(t, "-O") })
+	t.Run("Raw/sftp", func(t *testing.T) { testRaw(t) })
+	t.Run("Source/scp", func(t *testing.T) { testSource(t, "-O") })
+	t.Run("Source/sftp", func(t *testing.T) { testSource(t) })
+	t.Run("Source/names", func(t *testing.T) { testSourceNames(t, schttp.scpServer) })
 
-	reader, err := scp.StderrPipe()
+	shutdown.Done()
+}
+
+// testSink uploads test-directory with scp, preserving times, and downloads it as a tar.gz
+// - spooled uploads are expected to finish before anyone downloads them
+func testSink(t *testing.T, preservesDirectories, spooled bool, args ...string) {
+	// git cannot hold empty directories - add one to a copy of test-directory
+	base := t.TempDir()
+	copyDirectory(t, "test-directory", path.Join(base, "test-directory"))
+	err := os.Mkdir(path.Join(base, "test-directory", "emptydirectory"), 0700)
 	if err != nil {
-		t.Fatalf("could not get stderr pipe from scp command: %s", err)
+		t.Fatalf("unable to create empty directory: %s", err)
 	}
 
-	defer reader.Close()
+	url, wait := upload(t, base, append(args, "-r", "test-directory/")...)
 
-	t.Log("Executing ", scp.Args)
-	scp.Start()
+	landingText := "The uploader is connected"
+	if spooled {
+		err = wait()
+		if err != nil {
+			t.Fatalf("spooled scp failed: %s", err)
+		}
+		wait = func() error { return nil }
+		landingText = "stored on the server"
+	}
 
-	scanner := bufio.NewScanner(reader)
-	scanner.Split(bufio.ScanLines)
+	// browsers get a landing page
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("unable to create request: %s", err)
+	}
+	request.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	landing, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("unable to get landing page %s: %s", url, err)
+	}
+	page, err := io.ReadAll(landing.Body)
+	landing.Body.Close()
+	if err != nil || !strings.Contains(string(page), landingText) {
+		t.Fatalf("unexpected landing page: %v %s", err, page)
+	}
 
-	var url string
-	for scanner.Scan() {
-		line := strings.Trim(scanner.Text(), "\n ")
-		if strings.HasSuffix(line, ".tar.gz") {
-			// we found our string
-			url = line
-			break
-		}
+	// everything else get the default format, which is tar.gz
+	url = url + ".tar.gz"
+
+	// HEAD requests and link unfurlers must not consume the url
+	head, err := http.Head(url)
+	if err != nil || head.StatusCode != http.StatusOK {
+		t.Fatalf("unable to http head %s: %v %v", url, err, head)
 	}
 
-	if url == "" {
-		t.Fatalf("no url found in stderr from scp")
+	request, err = http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("unable to create request: %s", err)
+	}
+	request.Header.Set("User-Agent", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)")
+	preview, err := http.DefaultClient.Do(request)
+	if err != nil || preview.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("unable to unfurl %s: %v %v", url, err, preview)
 	}
+	preview.Body.Close()
 
-	// download this url and compare its checksum against a known value
-	response, err := http.Get(url)
+	// download this url, without its extension, and compare its checksum against a known value
+	response, err := http.Get(strings.TrimSuffix(url, ".tar.gz"))
 	if err != nil {
 		t.Fatalf("unable to http get %s: %s", url, err)
 	}
@@ -116,8 +193,8 @@ func TestMain(t *testing.T) {
 
 	tarReader := tar.NewReader(gzipReader)
 
-	h := md5.New()
-
+	contents := make(map[string][]byte)
+	directories := make(map[string]bool)
 	for {
 
 		header, err := tarReader.Next()
@@ -128,14 +205,54 @@ func TestMain(t *testing.T) {
 			t.Fatalf("tar error: %s", err)
 		}
 
+		// modes and times should be preserved
+		fi, err := os.Stat(path.Join(base, header.Name))
+		if err != nil {
+			t.Fatalf("unable to stat %s: %s", header.Name, err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			directories[path.Clean(header.Name)] = true
+			if !preservesDirectories {
+				continue
+			}
+		}
+
+		if header.FileInfo().Mode() != fi.Mode() {
+			t.Fatalf("wrong mode of %s: %s != %s", header.Name, header.FileInfo().Mode(), fi.Mode())
+		}
+
+		// directory times changes as files are copied into them
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		if !header.ModTime.Equal(fi.ModTime().Truncate(time.Second)) {
+			t.Fatalf("wrong modification time of %s: %s != %s", header.Name, header.ModTime, fi.ModTime())
+		}
+
+		content, err := io.ReadAll(tarReader)
+		if err != nil {
+			t.Fatalf("could not read %s: %s", header.Name, err)
+		}
+		contents[header.Name] = content
+	}
+
+	names := make([]string, 0, len(contents))
+	for name := range contents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := md5.New()
+	for _, name := range names {
 		// first just append the name of the file
-		_, err = h.Write([]byte(header.Name))
+		_, err = h.Write([]byte(name))
 		if err != nil {
 			t.Fatalf("could not update md5 digest: %s", err)
 		}
 
 		// then the whole content of the file
-		_, err = io.Copy(h, tarReader)
+		_, err = h.Write(contents[name])
 		if err != nil {
 			t.Fatalf("could not update md5 digest: %s", err)
 		}
@@ -146,5 +263,1274 @@ func TestMain(t *testing.T) {
 		t.Fatalf("wrong md5 hash of test-directory zip file: %s != %s", hexSum, KnownTestDirectoryHash)
 	}
 
-	shutdown.Done()
+	// every directory, including the empty one, should have its own entry
+	for _, name := range []string{
+		"test-directory",
+		"test-directory/emptydirectory",
+		"test-directory/levelone",
+		"test-directory/levelone/doubleleveltwo",
+		"test-directory/levelone/leveltwo",
+	} {
+		if !directories[name] {
+			t.Fatalf("missing directory entry %s", name)
+		}
+	}
+
+	err = wait()
+	if err != nil {
+		t.Fatalf("scp failed: %s", err)
+	}
+}
+
+// testStored spools test-directory and downloads it as a tar in two ranges
+func testStored(t *testing.T) {
+	url, wait := upload(t, ".", "-O", "-oUser=spool", "-r", "test-directory/")
+	err := wait()
+	if err != nil {
+		t.Fatalf("spooled scp failed: %s", err)
+	}
+	url = url + ".tar"
+
+	head, err := http.Head(url)
+	if err != nil || head.StatusCode != http.StatusOK || head.ContentLength <= 1000 ||
+		head.Header.Get("Accept-Ranges") != "bytes" || head.Header.Get("ETag") == "" {
+		t.Fatalf("unable to http head %s: %v %v", url, err, head)
+	}
+
+	// a download cut short is resumed from where it stopped, giving back the
+	// ETag of the download
+	etag := head.Header.Get("ETag")
+	request := func(ranges, etag string) *http.Response {
+		request, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatalf("unable to create request: %s", err)
+		}
+		request.Header.Set("Range", ranges)
+		request.Header.Set("If-Range", etag)
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("unable to get %s of %s: %s", ranges, url, err)
+		}
+		return response
+	}
+	get := func(ranges string) []byte {
+		response := request(ranges, etag)
+		if response.StatusCode != http.StatusPartialContent {
+			t.Fatalf("unable to get %s of %s: %v", ranges, url, response)
+		}
+		defer response.Body.Close()
+		etag = response.Header.Get("ETag")
+
+		b, err := io.ReadAll(response.Body)
+		if err != nil {
+			t.Fatalf("unable to read %s of %s: %s", ranges, url, err)
+		}
+		return b
+	}
+
+	// the end of the archive alone does not use up the download
+	if len(get("bytes=-1")) != 1 {
+		t.Fatalf("wrong length of the last byte of %s", url)
+	}
+	head, err = http.Head(url)
+	if err != nil || head.StatusCode != http.StatusOK {
+		t.Fatalf("transfer gone after its last byte was downloaded: %v %v", err, head)
+	}
+
+	// while the only download is in progress, no one else gets to start one
+	response := request("bytes=0-999", head.Header.Get("ETag"))
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotFound {
+		t.Fatalf("another download started while the only one was in progress: %v", response)
+	}
+
+	archive := append(get("bytes=0-999"), get("bytes=1000-")...)
+	if int64(len(archive)) != head.ContentLength {
+		t.Fatalf("wrong length: %d != %d", len(archive), head.ContentLength)
+	}
+
+	tr := tar.NewReader(bytes.NewReader(archive))
+	contents := make(map[string][]byte)
+	names := []string{}
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("tar error: %s", err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+
+		contents[header.Name], err = io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("could not read %s: %s", header.Name, err)
+		}
+		names = append(names, header.Name)
+	}
+	sort.Strings(names)
+
+	h := md5.New()
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write(contents[name])
+	}
+
+	hexSum := fmt.Sprintf("%x", h.Sum(nil))
+	if hexSum != KnownTestDirectoryHash {
+		t.Fatalf("wrong md5 hash of test-directory tar file: %s != %s", hexSum, KnownTestDirectoryHash)
+	}
+
+	// the whole archive have been downloaded, the transfer is gone
+	response, err = http.Get(url)
+	if err != nil || response.StatusCode != http.StatusNotFound {
+		t.Fatalf("transfer still available after download: %v %v", err, response)
+	}
+	response.Body.Close()
+}
+
+// testDownloads uploads a file which may be downloaded twice
+func testDownloads(t *testing.T) {
+	url, wait := upload(t, "test-directory/levelone/leveltwo", "-O", "-oUser=downloads=2,ttl=1h", "forest-sunbeams-trees-sunlight-70365.jpeg")
+	err := wait()
+	if err != nil {
+		t.Fatalf("spooled scp failed: %s", err)
+	}
+
+	// previews tell how many times the link works
+	request, err := http.NewRequest(http.MethodGet, url+".tar.gz", nil)
+	if err != nil {
+		t.Fatalf("unable to create request: %s", err)
+	}
+	request.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) SkypeUriPreview Preview/0.5")
+	preview, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("unable to unfurl %s: %s", url, err)
+	}
+	page, err := io.ReadAll(preview.Body)
+	preview.Body.Close()
+	if err != nil || !strings.Contains(string(page), "it works 2 more times") {
+		t.Fatalf("unexpected preview: %v %s", err, page)
+	}
+
+	// one download as .tar.gz, one as is - by browsers of apps also unfurling links
+	browsers := []string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Teams/24.1.0 Chrome/120.0 Safari/537.36",
+		"Mozilla/5.0 (Linux; Android 14) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0 Mobile Safari/537.36 Signalling/1.0",
+	}
+	for i, u := range []string{url + ".tar.gz", url + ".raw"} {
+		request, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			t.Fatalf("unable to create request: %s", err)
+		}
+		request.Header.Set("User-Agent", browsers[i])
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil || response.StatusCode != http.StatusOK {
+			t.Fatalf("unable to http get %s: %v %v", u, err, response)
+		}
+		_, err = io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatalf("unable to read %s: %s", u, err)
+		}
+
+		remaining := fmt.Sprint(1 - i)
+		if response.Header.Get("X-Downloads-Remaining") != remaining {
+			t.Fatalf("wrong remaining downloads: %q != %q", response.Header.Get("X-Downloads-Remaining"), remaining)
+		}
+	}
+
+	response, err := http.Get(url + ".tar.gz")
+	if err != nil || response.StatusCode != http.StatusNotFound {
+		t.Fatalf("transfer still available after two downloads: %v %v", err, response)
+	}
+	response.Body.Close()
+}
+
+// testFanout streams a single upload to two downloaders at once
+func testFanout(t *testing.T) {
+	const name = "forest-sunbeams-trees-sunlight-70365.jpeg"
+	base := "test-directory/levelone/leveltwo"
+
+	expected, err := os.ReadFile(path.Join(base, name))
+	if err != nil {
+		t.Fatalf("unable to read test file: %s", err)
+	}
+
+	url, wait := upload(t, base, "-O", "-oUser=fanout=2", name)
+
+	// the upload starts once both downloaders are here
+	var wg sync.WaitGroup
+	received := make([][]byte, 2)
+	errs := make([]error, 2)
+	for i := range received {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			response, err := http.Get(url + ".raw")
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer response.Body.Close()
+
+			received[i], errs[i] = io.ReadAll(response.Body)
+		}()
+	}
+	wg.Wait()
+
+	for i := range received {
+		if errs[i] != nil {
+			t.Fatalf("downloader %d failed: %s", i, errs[i])
+		}
+		if !bytes.Equal(expected, received[i]) {
+			t.Fatalf("downloader %d received a file which differs from the uploaded file", i)
+		}
+	}
+
+	err = wait()
+	if err != nil {
+		t.Fatalf("scp failed: %s", err)
+	}
+
+	// no one else may join once the upload is done
+	response, err := http.Get(url + ".tar.gz")
+	if err != nil || response.StatusCode != http.StatusNotFound {
+		t.Fatalf("fanout sink still available: %v %v", err, response)
+	}
+	response.Body.Close()
+}
+
+// testOptions names a transfer and picks its format with the target path,
+// and expects bad options to be turned down
+func testOptions(t *testing.T) {
+	url, wait := uploadTo(t, "test-directory/levelone/leveltwo", "release.zip", "-O", "-oUser=ttl=1h", "forest-sunbeams-trees-sunlight-70365.jpeg")
+	err := wait()
+	if err != nil {
+		t.Fatalf("spooled scp failed: %s", err)
+	}
+
+	response, err := http.Get(url)
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("unable to http get %s: %v %v", url, err, response)
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatalf("unable to read %s: %s", url, err)
+	}
+
+	if response.Header.Get("Content-Disposition") != "attachment; filename=release.zip" {
+		t.Fatalf("wrong content disposition: %s", response.Header.Get("Content-Disposition"))
+	}
+	if !bytes.HasPrefix(body, []byte("PK")) {
+		t.Fatalf("named transfer was not served as zip")
+	}
+
+	// the target is split as by a shell, flags are not looked for in it
+	url, wait = uploadTo(t, "test-directory/levelone/leveltwo", `"my -t release.zip"`, "-O", "-oUser=ttl=1h", "forest-sunbeams-trees-sunlight-70365.jpeg")
+	err = wait()
+	if err != nil {
+		t.Fatalf("spooled scp failed: %s", err)
+	}
+
+	response, err = http.Get(url)
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("unable to http get %s: %v %v", url, err, response)
+	}
+	response.Body.Close()
+
+	if response.Header.Get("Content-Disposition") != `attachment; filename="my -t release.zip"` {
+		t.Fatalf("wrong content disposition: %s", response.Header.Get("Content-Disposition"))
+	}
+
+	tests := []struct {
+		user, target string
+		output       string
+	}{
+		{user: "ttl=forever", output: `ttl: "forever" is not a positive duration`},
+		{target: "dowloads=3", output: "dowloads: unknown option"},
+		{target: "version=2.zip", output: "version: unknown option"},
+	}
+
+	for _, test := range tests {
+		args := []string{"-O", "-oStrictHostKeyChecking=no", fmt.Sprintf("-P%d", scpPort), "main.go", "127.0.0.1:" + test.target}
+		if test.user != "" {
+			args = append([]string{"-oUser=" + test.user}, args...)
+		}
+
+		output, err := exec.Command("scp", args...).CombinedOutput()
+		if err == nil {
+			t.Fatalf("scp with bad options %q did not fail", test.user+test.target)
+		}
+		if !strings.Contains(string(output), test.output) {
+			t.Fatalf("bad option %q not reported: %s", test.user+test.target, output)
+		}
+	}
+}
+
+// testPassword protects a transfer with a password, wrong passwords must not consume it
+func testPassword(t *testing.T) {
+	url, wait := upload(t, "test-directory/levelone/leveltwo", "-O", "-oUser=downloads=2,password=secret", "forest-sunbeams-trees-sunlight-70365.jpeg")
+	err := wait()
+	if err != nil {
+		t.Fatalf("spooled scp failed: %s", err)
+	}
+
+	// no password and a wrong password
+	for _, password := range []string{"", "wrong"} {
+		request, err := http.NewRequest(http.MethodGet, url+".tar.gz", nil)
+		if err != nil {
+			t.Fatalf("unable to create request: %s", err)
+		}
+		if password != "" {
+			request.SetBasicAuth("", password)
+		}
+
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("unable to http get %s: %s", url, err)
+		}
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusUnauthorized || response.Header.Get("WWW-Authenticate") == "" {
+			t.Fatalf("password %q was not turned down: %v", password, response)
+		}
+	}
+
+	// browsers get a form
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("unable to create request: %s", err)
+	}
+	request.Header.Set("Accept", "text/html")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("unable to http get %s: %s", url, err)
+	}
+	page, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil || response.StatusCode != http.StatusUnauthorized || !strings.Contains(string(page), `name="password"`) {
+		t.Fatalf("no password form: %v %v %s", err, response, page)
+	}
+
+	// the landing page shows commands giving the password
+	request.SetBasicAuth("", "secret")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("unable to http get %s: %s", url, err)
+	}
+	page, err = io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil || response.StatusCode != http.StatusOK || !strings.Contains(string(page), "curl -u :PASSWORD") {
+		t.Fatalf("no commands with the password: %v %v %s", err, response, page)
+	}
+
+	// the password also encrypts zip files
+	request, err = http.NewRequest(http.MethodGet, url+".aes.zip", nil)
+	if err != nil {
+		t.Fatalf("unable to create request: %s", err)
+	}
+	request.SetBasicAuth("", "secret")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("unable to download encrypted zip: %v %v", err, response)
+	}
+	encrypted, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatalf("unable to read encrypted zip: %s", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(encrypted), int64(len(encrypted)))
+	if err != nil || len(zr.File) != 1 || zr.File[0].Flags&0x1 == 0 {
+		t.Fatalf("download is not an encrypted zip: %v", err)
+	}
+
+	// browsers giving the password carry on with a session, rather than having it put in the page
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("unable to create cookie jar: %s", err)
+	}
+	browser := &http.Client{Jar: jar}
+
+	request, err = http.NewRequest(http.MethodPost, url, strings.NewReader("password=secret"))
+	if err != nil {
+		t.Fatalf("unable to create request: %s", err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "text/html")
+	response, err = browser.Do(request)
+	if err != nil {
+		t.Fatalf("unable to http post %s: %s", url, err)
+	}
+	page, err = io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil || response.StatusCode != http.StatusOK || strings.Contains(string(page), "secret") ||
+		response.Header.Get("Cache-Control") != "no-store" {
+		t.Fatalf("password given away by the landing page: %v %v %s", err, response, page)
+	}
+
+	response, err = browser.PostForm(url+".zip", nil)
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("unable to download with session: %v %v", err, response)
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil || !bytes.HasPrefix(body, []byte("PK")) {
+		t.Fatalf("unable to read download: %v", err)
+	}
+
+	response, err = http.PostForm(url+".zip", map[string][]string{"password": {"secret"}})
+	if err != nil || response.StatusCode != http.StatusNotFound {
+		t.Fatalf("transfer still available after download: %v %v", err, response)
+	}
+	response.Body.Close()
+}
+
+// testRecipient encrypts transfers to a public key, given as is and by its fingerprint
+func testRecipient(t *testing.T, recipients string) {
+	const name = "forest-sunbeams-trees-sunlight-70365.jpeg"
+	base := "test-directory/levelone/leveltwo"
+
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatalf("unable to convert key: %s", err)
+	}
+	identity, err := agessh.NewEd25519Identity(private)
+	if err != nil {
+		t.Fatalf("unable to create identity: %s", err)
+	}
+
+	// fingerprints are looked up in the recipient directory
+	err = os.WriteFile(path.Join(recipients, "colleague.pub"), ssh.MarshalAuthorizedKey(key), 0600)
+	if err != nil {
+		t.Fatalf("unable to write recipient: %s", err)
+	}
+
+	expected, err := os.ReadFile(path.Join(base, name))
+	if err != nil {
+		t.Fatalf("unable to read test file: %s", err)
+	}
+
+	for _, user := range []string{
+		"recipient=" + base64.StdEncoding.EncodeToString(key.Marshal()),
+		"spool,recipient=" + ssh.FingerprintSHA256(key),
+	} {
+		url, wait := upload(t, base, "-O", "-oUser="+user, name)
+
+		// spooled transfers are available once the upload is done
+		if strings.HasPrefix(user, "spool") {
+			err = wait()
+			if err != nil {
+				t.Fatalf("spooled scp failed: %s", err)
+			}
+			wait = func() error { return nil }
+		}
+
+		// unencrypted downloads are turned down
+		response, err := http.Get(url + ".tar")
+		if err != nil || response.StatusCode != http.StatusBadRequest {
+			t.Fatalf("unencrypted download was not turned down: %v %v", err, response)
+		}
+		response.Body.Close()
+
+		response, err = http.Get(url + ".tar.age")
+		if err != nil || response.StatusCode != http.StatusOK {
+			t.Fatalf("unable to http get %s: %v %v", url, err, response)
+		}
+
+		decrypted, err := age.Decrypt(response.Body, identity)
+		if err != nil {
+			t.Fatalf("unable to decrypt download: %s", err)
+		}
+
+		tr := tar.NewReader(decrypted)
+		header, err := tr.Next()
+		if err != nil || header.Name != name {
+			t.Fatalf("unexpected tar entry: %v %v", err, header)
+		}
+		received, err := io.ReadAll(tr)
+		if err != nil || !bytes.Equal(expected, received) {
+			t.Fatalf("decrypted file differs from the uploaded file: %v", err)
+		}
+		response.Body.Close()
+
+		err = wait()
+		if err != nil {
+			t.Fatalf("scp failed: %s", err)
+		}
+	}
+}
+
+// testAuthorizedKeys runs a server only allowing keys of an authorized_keys file
+func testAuthorizedKeys(t *testing.T) {
+	dir := t.TempDir()
+
+	// newKey writes a private key for scp and returns its authorized_keys line
+	newKey := func(name string) string {
+		_, private, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("unable to generate key: %s", err)
+		}
+		block, err := ssh.MarshalPrivateKey(private, "")
+		if err != nil {
+			t.Fatalf("unable to marshal key: %s", err)
+		}
+		err = os.WriteFile(path.Join(dir, name), pem.EncodeToMemory(block), 0600)
+		if err != nil {
+			t.Fatalf("unable to write key: %s", err)
+		}
+
+		signer, err := ssh.NewSignerFromKey(private)
+		if err != nil {
+			t.Fatalf("unable to create signer: %s", err)
+		}
+		return string(ssh.MarshalAuthorizedKey(signer.PublicKey()))
+	}
+
+	authorized := "max-ttl=1h " + newKey("allowed") +
+		"max-ttl=1s " + newKey("brief") +
+		"quota=1K " + newKey("limited") +
+		`from="10.0.0.0/8,!10.0.0.1" ` + newKey("elsewhere")
+	newKey("unknown")
+
+	err := os.WriteFile(path.Join(dir, "authorized_keys"), []byte(authorized), 0600)
+	if err != nil {
+		t.Fatalf("unable to write authorized keys: %s", err)
+	}
+
+	server := scp.NewServer()
+	err = server.RequireKeys(path.Join(dir, "authorized_keys"), "", nil)
+	if err != nil {
+		t.Fatalf("unable to require keys: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	go server.Listen(listener)
+	defer server.Shutdown("shutting down authorized keys test server")
+
+	tests := []struct {
+		key, user string
+		output    string
+	}{
+		{key: "allowed", user: "spool", output: "stored on the server"},
+		{key: "allowed", user: "ttl=2h", output: "ttl: your key allows at most 1h0m0s"},
+		{key: "brief", user: "waiting", output: "Nobody downloaded the transfer within 1s"},
+		{key: "limited", user: "spool", output: "transfer exceeds the quota of your key"},
+		{key: "elsewhere", user: "spool", output: "Permission denied"},
+		{key: "unknown", user: "spool", output: "Permission denied"},
+	}
+
+	for _, test := range tests {
+		scp := exec.Command("scp", "-O",
+			"-oStrictHostKeyChecking=no", "-oBatchMode=yes", "-oIdentitiesOnly=yes",
+			"-i", path.Join(dir, test.key),
+			"-P", fmt.Sprint(listener.Addr().(*net.TCPAddr).Port),
+			"-oUser="+test.user,
+			"test-directory/levelone/leveltwo/forest-sunbeams-trees-sunlight-70365.jpeg", "127.0.0.1:",
+		)
+		output, err := scp.CombinedOutput()
+		if !strings.Contains(string(output), test.output) {
+			t.Fatalf("%s as %s: %q not found in output: %s", test.key, test.user, test.output, output)
+		}
+
+		if (err == nil) != (test.output == "stored on the server") {
+			t.Fatalf("%s as %s: unexpected result: %v", test.key, test.user, err)
+		}
+	}
+}
+
+// testCertificates runs a server only allowing certificates of a user ca,
+// with a host certificate signed by the same authority
+func testCertificates(t *testing.T) {
+	dir := t.TempDir()
+
+	_, caKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("unable to generate ca key: %s", err)
+	}
+	ca, err := ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		t.Fatalf("unable to create ca signer: %s", err)
+	}
+
+	// sign writes an OpenSSH certificate next to the key at keyFile
+	sign := func(keyFile string, cert *ssh.Certificate) {
+		err := cert.SignCert(rand.New(rand.NewSource(time.Now().UnixNano())), ca)
+		if err != nil {
+			t.Fatalf("unable to sign certificate: %s", err)
+		}
+		err = os.WriteFile(keyFile+"-cert.pub", ssh.MarshalAuthorizedKey(cert), 0600)
+		if err != nil {
+			t.Fatalf("unable to write certificate: %s", err)
+		}
+	}
+
+	// newCert writes a private key with a certificate for scp
+	newCert := func(name string, principals []string, validBefore time.Time) {
+		public, private, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatalf("unable to generate key: %s", err)
+		}
+		block, err := ssh.MarshalPrivateKey(private, "")
+		if err != nil {
+			t.Fatalf("unable to marshal key: %s", err)
+		}
+		err = os.WriteFile(path.Join(dir, name), pem.EncodeToMemory(block), 0600)
+		if err != nil {
+			t.Fatalf("unable to write key: %s", err)
+		}
+
+		key, err := ssh.NewPublicKey(public)
+		if err != nil {
+			t.Fatalf("unable to create public key: %s", err)
+		}
+		sign(path.Join(dir, name), &ssh.Certificate{
+			Key:             key,
+			CertType:        ssh.UserCert,
+			KeyId:           name + "@example.com",
+			ValidPrincipals: principals,
+			ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+			ValidBefore:     uint64(validBefore.Unix()),
+		})
+	}
+
+	newCert("valid", []string{"uploaders", "staff"}, time.Now().Add(time.Hour))
+	newCert("expired", []string{"uploaders"}, time.Now().Add(-time.Minute))
+	newCert("stranger", []string{"visitors"}, time.Now().Add(time.Hour))
+
+	err = os.WriteFile(path.Join(dir, "user_ca"), ssh.MarshalAuthorizedKey(ca.PublicKey()), 0600)
+	if err != nil {
+		t.Fatalf("unable to write user ca: %s", err)
+	}
+
+	// certify the host key of the earlier servers, which this one shares
+	const hostKey = "schttp.test_host_ed25519_key"
+	data, err := os.ReadFile(hostKey + ".pub")
+	if err != nil {
+		t.Fatalf("unable to read host key: %s", err)
+	}
+	host, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		t.Fatalf("unable to parse host key: %s", err)
+	}
+	sign(hostKey, &ssh.Certificate{
+		Key:             host,
+		CertType:        ssh.HostCert,
+		KeyId:           "test host",
+		ValidPrincipals: []string{"127.0.0.1"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	})
+	defer os.Remove(hostKey + "-cert.pub")
+
+	knownHosts := path.Join(dir, "known_hosts")
+	err = os.WriteFile(knownHosts, []byte("@cert-authority * "+string(ssh.MarshalAuthorizedKey(ca.PublicKey()))), 0600)
+	if err != nil {
+		t.Fatalf("unable to write known hosts: %s", err)
+	}
+
+	server := scp.NewServer()
+	err = server.RequireKeys("", path.Join(dir, "user_ca"), []string{"uploaders"})
+	if err != nil {
+		t.Fatalf("unable to require certificates: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	go server.Listen(listener)
+	defer server.Shutdown("shutting down certificates test server")
+
+	command := func(key string) *exec.Cmd {
+		return exec.Command("scp", "-O",
+			"-oStrictHostKeyChecking=yes", "-oUserKnownHostsFile="+knownHosts,
+			"-oHostKeyAlgorithms=ssh-ed25519-cert-v01@openssh.com",
+			"-oBatchMode=yes", "-oIdentitiesOnly=yes",
+			"-i", path.Join(dir, key),
+			"-P", fmt.Sprint(listener.Addr().(*net.TCPAddr).Port),
+			"test-directory/levelone/leveltwo/forest-sunbeams-trees-sunlight-70365.jpeg", "127.0.0.1:",
+		)
+	}
+
+	for _, key := range []string{"expired", "stranger"} {
+		output, err := command(key).CombinedOutput()
+		if err == nil || !strings.Contains(string(output), "Permission denied") {
+			t.Fatalf("%s: expected permission denied: %v: %s", key, err, output)
+		}
+	}
+
+	// the valid certificate waits for a downloader, its sink carries the identity
+	valid := command("valid")
+	reader, err := valid.StderrPipe()
+	if err != nil {
+		t.Fatalf("could not get stderr pipe from scp command: %s", err)
+	}
+	err = valid.Start()
+	if err != nil {
+		t.Fatalf("could not start scp: %s", err)
+	}
+	defer func() {
+		_ = valid.Process.Kill()
+		_ = valid.Wait()
+	}()
+
+	var id string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasSuffix(line, ".tar.gz") {
+			id = path.Base(strings.TrimSuffix(line, ".tar.gz"))
+			break
+		}
+	}
+	go io.Copy(io.Discard, reader)
+
+	if id == "" {
+		t.Fatalf("no url found in stderr from scp")
+	}
+
+	peeked, err := server.Peek(id)
+	if err != nil {
+		t.Fatalf("unable to peek sink: %s", err)
+	}
+	sink := peeked.(*scp.Sink)
+	if sink.KeyID != "valid@example.com" {
+		t.Fatalf("wrong key id: %q", sink.KeyID)
+	}
+	if strings.Join(sink.Principals, ",") != "uploaders,staff" {
+		t.Fatalf("wrong principals: %v", sink.Principals)
+	}
+}
+
+// testProgress checks the uploader is told about the downloader and the transfer
+func testProgress(t *testing.T) {
+	url, wait := uploadStderr(t, "-r", "test-directory/")
+
+	request, err := http.NewRequest(http.MethodGet, url+".zip", nil)
+	if err != nil {
+		t.Fatalf("unable to create request: %s", err)
+	}
+	request.Header.Set("User-Agent", `progress "test"`)
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("unable to http get %s: %s", url, err)
+	}
+	_, err = io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	if err != nil {
+		t.Fatalf("unable to read response: %s", err)
+	}
+
+	rest, err := wait()
+	if err != nil {
+		t.Fatalf("scp failed: %s", err)
+	}
+
+	// the user agent is quoted
+	for _, expected := range []string{`("progress \"test\"") as zip`, "Transferred 3 files", "delivered to the downloader"} {
+		if !strings.Contains(string(rest), expected) {
+			t.Fatalf("%q not found in stderr from scp: %s", expected, rest)
+		}
+	}
+}
+
+// testKeepalive runs a server with short keepalives and maximum wait, through a
+// proxy able to stop forwarding as NAT gateways do
+func testKeepalive(t *testing.T) {
+	server := scp.NewServer()
+	server.Keepalive = 100 * time.Millisecond
+	server.KeepaliveCountMax = 2
+	server.MaxWait = 2 * time.Second
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	go server.Listen(listener)
+	defer server.Shutdown("shutting down keepalive test server")
+
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	defer proxy.Close()
+
+	// frozen connections stop forwarding without closing
+	frozen := make(chan struct{})
+	go func() {
+		for {
+			client, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				client.Close()
+				continue
+			}
+
+			forward := func(dst, src net.Conn) {
+				b := make([]byte, 32<<10)
+				for {
+					n, err := src.Read(b)
+					if err != nil {
+						dst.Close()
+						return
+					}
+					select {
+					case <-frozen:
+						return
+					default:
+					}
+					_, err = dst.Write(b[:n])
+					if err != nil {
+						return
+					}
+				}
+			}
+			go forward(upstream, client)
+			go forward(client, upstream)
+		}
+	}()
+
+	// start uploads through the proxy, returning the id of the sink
+	start := func() (*exec.Cmd, string, io.Reader) {
+		scp := exec.Command("scp", "-O",
+			"-oStrictHostKeyChecking=no", "-oServerAliveInterval=0",
+			"-P", fmt.Sprint(proxy.Addr().(*net.TCPAddr).Port),
+			"test-directory/levelone/leveltwo/forest-sunbeams-trees-sunlight-70365.jpeg", "127.0.0.1:",
+		)
+		reader, err := scp.StderrPipe()
+		if err != nil {
+			t.Fatalf("could not get stderr pipe from scp command: %s", err)
+		}
+		err = scp.Start()
+		if err != nil {
+			t.Fatalf("could not start scp: %s", err)
+		}
+
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if strings.HasSuffix(line, ".tar.gz") {
+				return scp, path.Base(strings.TrimSuffix(line, ".tar.gz")), reader
+			}
+		}
+		t.Fatalf("no url found in stderr from scp")
+		return nil, "", nil
+	}
+
+	// uploaders waiting for too long are told so
+	scp, id, reader := start()
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("unable to read stderr from scp: %s", err)
+	}
+	if scp.Wait() == nil || !strings.Contains(string(rest), "Nobody downloaded the transfer within 2s") {
+		t.Fatalf("expected scp to give up: %s", rest)
+	}
+	if _, err := server.Peek(id); err == nil {
+		t.Fatalf("sink %s was not removed", id)
+	}
+
+	// uploaders behind a dead connection are removed
+	scp, id, _ = start()
+	defer func() {
+		_ = scp.Process.Kill()
+		_ = scp.Wait()
+	}()
+	close(frozen)
+
+	time.Sleep(time.Second)
+	if _, err := server.Peek(id); err == nil {
+		t.Fatalf("sink %s of a dead connection was not removed", id)
+	}
+}
+
+// testReplies checks failed downloads are replied to with a message the scp client prints
+func testReplies(t *testing.T) {
+	url, wait := uploadStderr(t, "-r", "test-directory/")
+
+	response, err := http.Get(url + ".raw")
+	if err != nil {
+		t.Fatalf("unable to http get %s: %s", url, err)
+	}
+	response.Body.Close()
+
+	rest, err := wait()
+	if err == nil {
+		t.Fatalf("scp did not fail")
+	}
+
+	const expected = "transfer failed after 0 files: upload contains a directory"
+	if !strings.Contains(rest, expected) {
+		t.Fatalf("%q not found in stderr from scp: %s", expected, rest)
+	}
+	if strings.Contains(rest, "lost connection") {
+		t.Fatalf("scp lost its connection: %s", rest)
+	}
+}
+
+// testSFTPMaxSize checks sftp uploads are turned down once they would spool too much to disk
+func testSFTPMaxSize(t *testing.T) {
+	server := scp.NewServer()
+	server.SFTPMaxSize = 1024
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	go server.Listen(listener)
+	defer server.Shutdown("shutting down sftp test server")
+
+	scp := exec.Command("scp", "-oStrictHostKeyChecking=no", fmt.Sprintf("-P%d", listener.Addr().(*net.TCPAddr).Port),
+		"test-directory/levelone/leveltwo/forest-sunbeams-trees-sunlight-70365.jpeg", "127.0.0.1:",
+	)
+
+	output, err := scp.CombinedOutput()
+	if err == nil {
+		t.Fatalf("scp did not fail: %s", output)
+	}
+
+	const expected = "sftp uploads are limited to 1024 bytes"
+	if !strings.Contains(string(output), expected) {
+		t.Fatalf("%q not found in output from scp: %s", expected, output)
+	}
+}
+
+// uploadStderr uploads with the legacy scp protocol, returning the url of the
+// sink and a function waiting for scp with the rest of its stderr
+func uploadStderr(t *testing.T, args ...string) (string, func() (string, error)) {
+	args = append([]string{"-O", "-oStrictHostKeyChecking=no", fmt.Sprintf("-P%d", scpPort)}, args...)
+	scp := exec.Command("scp", append(args, "127.0.0.1:")...)
+
+	reader, err := scp.StderrPipe()
+	if err != nil {
+		t.Fatalf("could not get stderr pipe from scp command: %s", err)
+	}
+	err = scp.Start()
+	if err != nil {
+		t.Fatalf("could not start scp: %s", err)
+	}
+
+	var url string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasSuffix(line, ".tar.gz") {
+			url = strings.TrimSuffix(line, ".tar.gz")
+			break
+		}
+	}
+	if url == "" {
+		t.Fatalf("no url found in stderr from scp")
+	}
+
+	return url, func() (string, error) {
+		rest, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("unable to read stderr from scp: %s", err)
+		}
+		return string(rest), scp.Wait()
+	}
+}
+
+// testRaw uploads a single file and downloads it as is
+func testRaw(t *testing.T, args ...string) {
+	const name = "forest-sunbeams-trees-sunlight-70365.jpeg"
+	base := "test-directory/levelone/leveltwo"
+
+	url, wait := upload(t, base, append(args, name)...)
+
+	response, err := http.Get(url + "/" + name)
+	if err != nil {
+		t.Fatalf("unable to http get %s: %s", url, err)
+	}
+	defer response.Body.Close()
+
+	if response.Header.Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("wrong content type: %s", response.Header.Get("Content-Type"))
+	}
+	if response.Header.Get("Content-Disposition") != "attachment; filename="+name {
+		t.Fatalf("wrong content disposition: %s", response.Header.Get("Content-Disposition"))
+	}
+
+	received, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("unable to read response: %s", err)
+	}
+
+	expected, err := os.ReadFile(path.Join(base, name))
+	if err != nil {
+		t.Fatalf("unable to read test file: %s", err)
+	}
+
+	if !bytes.Equal(expected, received) {
+		t.Fatalf("received file differs from the uploaded file")
+	}
+
+	err = wait()
+	if err != nil {
+		t.Fatalf("scp failed: %s", err)
+	}
+
+	// directories cannot be downloaded as is
+	url, wait = upload(t, ".", append(args, "-r", "test-directory/")...)
+
+	response, err = http.Get(url + ".raw")
+	if err != nil {
+		t.Fatalf("unable to http get %s: %s", url, err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusConflict {
+		t.Fatalf("wrong status code for raw directory: %d", response.StatusCode)
+	}
+
+	// the uploader should be told the upload failed
+	if wait() == nil {
+		t.Fatalf("scp did not fail")
+	}
+
+	// several files are either turned down up front, or never look complete
+	url, wait = upload(t, "test-directory", append(args, path.Join("levelone/leveltwo", name), "tekst.txt")...)
+
+	response, err = http.Get(url + ".raw")
+	if err != nil {
+		t.Fatalf("unable to http get %s: %s", url, err)
+	}
+	_, err = io.ReadAll(response.Body)
+	response.Body.Close()
+
+	if response.StatusCode == http.StatusConflict {
+		// the upload is still available in other formats
+		response, err = http.Get(url + ".tar.gz")
+		if err != nil {
+			t.Fatalf("unable to http get %s: %s", url, err)
+		}
+		_, err = io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatalf("unable to read tar.gz of several files: %s", err)
+		}
+
+		err = wait()
+		if err != nil {
+			t.Fatalf("scp failed: %s", err)
+		}
+		return
+	}
+
+	if err == nil {
+		t.Fatalf("raw download of several files looks complete")
+	}
+	if wait() == nil {
+		t.Fatalf("scp did not fail")
+	}
+}
+
+// upload starts scp in dir and returns the url announced, without extension,
+// and a function waiting for scp to exit
+func upload(t *testing.T, dir string, args ...string) (string, func() error) {
+	return uploadTo(t, dir, "", args...)
+}
+
+// uploadTo is upload with a target path
+func uploadTo(t *testing.T, dir, target string, args ...string) (string, func() error) {
+	args = append([]string{
+		"-oStrictHostKeyChecking=no",
+		fmt.Sprintf("-P%d", scpPort),
+	}, args...)
+	scp := exec.Command("scp", append(args, "127.0.0.1:"+target)...)
+	scp.Dir = dir
+
+	reader, err := scp.StderrPipe()
+	if err != nil {
+		t.Fatalf("could not get stderr pipe from scp command: %s", err)
+	}
+
+	t.Log("Executing ", scp.Args)
+	err = scp.Start()
+	if err != nil {
+		t.Fatalf("could not start scp: %s", err)
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Split(bufio.ScanLines)
+
+	var url string
+	for scanner.Scan() {
+		line := strings.Trim(scanner.Text(), "\n ")
+		// encrypted transfers are listed with .age
+		line = strings.TrimSuffix(line, ".age")
+		if strings.HasSuffix(line, ".tar.gz") {
+			// we found our string
+			url = strings.TrimSuffix(line, ".tar.gz")
+			break
+		}
+	}
+
+	if url == "" {
+		t.Fatalf("no url found in stderr from scp")
+	}
+
+	return url, func() error {
+		// drain stderr to let scp exit
+		_, _ = io.Copy(io.Discard, reader)
+		return scp.Wait()
+	}
+}
+
+// testSource uploads a file over http and fetches it with scp
+func testSource(t *testing.T, args ...string) {
+	const name = "forest-sunbeams-trees-sunlight-70365.jpeg"
+	fd, err := os.Open(path.Join("test-directory/levelone/leveltwo", name))
+	if err != nil {
+		t.Fatalf("unable to open test file: %s", err)
+	}
+	defer fd.Close()
+
+	fi, err := fd.Stat()
+	if err != nil {
+		t.Fatalf("unable to stat test file: %s", err)
+	}
+
+	request, err := http.NewRequest(http.MethodPut, fmt.Sprintf("http://127.0.0.1:%d/source/%s", httpPort, name), fd)
+	if err != nil {
+		t.Fatalf("unable to create request: %s", err)
+	}
+	request.ContentLength = fi.Size()
+
+	// the response arrives while the body is still being uploaded
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("unable to upload source: %s", err)
+	}
+	defer response.Body.Close()
+
+	scanner := bufio.NewScanner(response.Body)
+
+	var id string
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "scp -r") {
+			fields := strings.Fields(line)
+			target := fields[len(fields)-2]
+			id = target[strings.LastIndex(target, ":")+1:]
+			break
+		}
+	}
+
+	if id == "" {
+		t.Fatalf("no id found in source response")
+	}
+
+	destination := t.TempDir()
+	args = append(args,
+		"-oStrictHostKeyChecking=no",
+		fmt.Sprintf("-P%d", scpPort),
+		"-r", fmt.Sprintf("127.0.0.1:%s", id), destination,
+	)
+	scp := exec.Command("scp", args...)
+
+	t.Log("Executing ", scp.Args)
+	output, err := scp.CombinedOutput()
+	if err != nil {
+		t.Fatalf("scp failed: %s: %s", err, output)
+	}
+
+	expected, err := os.ReadFile(fd.Name())
+	if err != nil {
+		t.Fatalf("unable to read test file: %s", err)
+	}
+
+	// fetching the id itself results in a directory named after the id
+	received, err := os.ReadFile(path.Join(destination, id, name))
+	if err != nil {
+		t.Fatalf("unable to read received file: %s", err)
+	}
+
+	if !bytes.Equal(expected, received) {
+		t.Fatalf("received file differs from the uploaded file")
+	}
+}
+
+func testSourceNames(t *testing.T, db web.DB) {
+	// names are sent to scp clients in scp records, which end at newlines
+	for _, name := range []string{"evil%0AD0755%200%20dir", "carriage%0Dreturn", "bell%07"} {
+		response, err := http.Post(fmt.Sprintf("http://127.0.0.1:%d/source/%s", httpPort, name), "text/plain", strings.NewReader("contents"))
+		if err != nil {
+			t.Fatalf("unable to upload source: %s", err)
+		}
+		response.Body.Close()
+
+		if response.StatusCode != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %s", name, response.Status)
+		}
+	}
+
+	// multipart uploads are spooled to disk, up to a limit
+	server := httptest.NewServer(http.HandlerFunc((&web.Server{DB: db, MultipartMaxSize: 1024}).Source))
+	defer server.Close()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", "large.bin")
+	if err != nil {
+		t.Fatalf("unable to create multipart body: %s", err)
+	}
+	part.Write(make([]byte, 2048))
+	mw.Close()
+
+	response, err := http.Post(server.URL+"/source/", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatalf("unable to upload source: %s", err)
+	}
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for a large multipart upload, got %s", response.Status)
+	}
+}
+
+// copyDirectory copies a directory tree preserving modes and times
+func copyDirectory(t *testing.T, src, dst string) {
+	err := filepath.Walk(src, func(name string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		target := filepath.Join(dst, strings.TrimPrefix(name, src))
+		if fi.IsDir() {
+			err = os.MkdirAll(target, fi.Mode().Perm())
+		} else {
+			var content []byte
+			content, err = os.ReadFile(name)
+			if err == nil {
+				err = os.WriteFile(target, content, fi.Mode().Perm())
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		return os.Chtimes(target, fi.ModTime(), fi.ModTime())
+	})
+	if err != nil {
+		t.Fatalf("unable to copy %s: %s", src, err)
+	}
 }
@@ -0,0 +1,174 @@
+package packer
+
+import (
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"hash"
+	"io"
+)
+
+// AESZipExtension is the extension of zip files encrypted with WinZip AES
+const AESZipExtension = "aes.zip"
+
+// winzipAES is the compression method of WinZip AES encrypted entries,
+// the real compression method is found in their extra field
+const winzipAES = 99
+
+// aesExtra is the WinZip AES extra field: AE-1, AES-256 and deflate
+// - AE-1 keeps the CRC-32 of the contents, which the zip writer computes as it goes
+var aesExtra = []byte{
+	0x01, 0x99, // header id
+	0x07, 0x00, // size
+	0x01, 0x00, // AE-1
+	'A', 'E', // vendor
+	0x03,       // AES-256
+	0x08, 0x00, // deflate
+}
+
+const (
+	aesSaltSize = 16
+	aesKeySize  = 32
+	aesMACSize  = 10
+)
+
+// NewAESZip returns a zip packer encrypting file contents with WinZip AES-256,
+// as supported by 7-Zip, WinZip and most other unzippers but not Explorer
+func NewAESZip(w io.Writer, password string) *Zip {
+	z := NewZip(w)
+	z.encrypted = true
+	z.RegisterCompressor(winzipAES, func(w io.Writer) (io.WriteCloser, error) {
+		return newAESWriter(w, password)
+	})
+	return z
+}
+
+// aesWriter deflates and encrypts the contents of an entry
+type aesWriter struct {
+	*flate.Writer
+
+	// w is the zip entry, ciphertext is written here
+	w      io.Writer
+	stream cipher.Stream
+	mac    hash.Hash
+	buf    []byte
+
+	// header is the salt and password verifier, it is written ahead of
+	// the ciphertext as the zip writer creates compressors before writing
+	// the header of the entry
+	header []byte
+}
+
+// newAESWriter returns a writer encrypting an entry written to w
+func newAESWriter(w io.Writer, password string) (*aesWriter, error) {
+	salt := make([]byte, aesSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := pbkdf2.Key(sha1.New, password, salt, 1000, 2*aesKeySize+2)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(keys[:aesKeySize])
+	if err != nil {
+		return nil, err
+	}
+
+	a := &aesWriter{
+		w:      w,
+		header: append(salt, keys[2*aesKeySize:]...),
+		stream: &aesCTR{block: block, used: aes.BlockSize},
+		mac:    hmac.New(sha1.New, keys[aesKeySize:2*aesKeySize]),
+	}
+
+	a.Writer, err = flate.NewWriter(writerFunc(a.encrypt), flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// writeHeader writes the salt and password verifier, once
+func (a *aesWriter) writeHeader() error {
+	if a.header == nil {
+		return nil
+	}
+
+	_, err := a.w.Write(a.header)
+	a.header = nil
+	return err
+}
+
+// encrypt encrypts compressed contents to the entry
+func (a *aesWriter) encrypt(p []byte) (int, error) {
+	err := a.writeHeader()
+	if err != nil {
+		return 0, err
+	}
+
+	if cap(a.buf) < len(p) {
+		a.buf = make([]byte, len(p))
+	}
+	out := a.buf[:len(p)]
+
+	a.stream.XORKeyStream(out, p)
+	a.mac.Write(out)
+
+	return a.w.Write(out)
+}
+
+// Close flushes the compressor and writes the authentication code
+func (a *aesWriter) Close() error {
+	err := a.Writer.Close()
+	if err == nil {
+		err = a.writeHeader()
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = a.w.Write(a.mac.Sum(nil)[:aesMACSize])
+	return err
+}
+
+// aesCTR is AES in counter mode with the little endian counter of WinZip,
+// starting at 1
+type aesCTR struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	key     [aes.BlockSize]byte
+	used    int
+}
+
+func (c *aesCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.used == aes.BlockSize {
+			for j := range c.counter {
+				c.counter[j]++
+				if c.counter[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.key[:], c.counter[:])
+			c.used = 0
+		}
+
+		dst[i] = src[i] ^ c.key[c.used]
+		c.used++
+	}
+}
+
+// writerFunc is a function implementing io.Writer
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
@@ -0,0 +1,80 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/agessh"
+)
+
+// AgeExtension is appended to the extension of formats encrypted with age
+const AgeExtension = "age"
+
+// AgeMIMEType is the Content-Type of age encrypted archives
+const AgeMIMEType = "application/octet-stream"
+
+// ParseRecipient parses an age recipient, either a native age1... recipient
+// or an ssh-ed25519 or ssh-rsa public key as found in authorized_keys files
+func ParseRecipient(s string) (age.Recipient, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.HasPrefix(s, "age1") {
+		return age.ParseX25519Recipient(s)
+	}
+
+	// leave out any comment after the key
+	fields := strings.Fields(s)
+	if len(fields) > 2 {
+		s = strings.Join(fields[:2], " ")
+	}
+
+	return agessh.ParseRecipient(s)
+}
+
+// Encrypted packs with format to w through an age encrypted container,
+// only recipient is able to decrypt the archive
+type Encrypted struct {
+	PackerCloser
+
+	// w is the age writer, it must be closed after the packer
+	w io.WriteCloser
+}
+
+// NewEncrypted returns a packer of format writing to w encrypted to recipient
+func NewEncrypted(format Format, w io.Writer, recipient string) (*Encrypted, error) {
+	r, err := ParseRecipient(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse recipient: %w", err)
+	}
+
+	aw, err := age.Encrypt(w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := format.New(aw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Encrypted{PackerCloser: p, w: aw}, nil
+}
+
+// Times passes file times on to the underlying packer, if it is able to preserve them
+func (e *Encrypted) Times(modified, accessed time.Time) {
+	if ts, ok := e.PackerCloser.(Timestamper); ok {
+		ts.Times(modified, accessed)
+	}
+}
+
+// Close closes the packer and then the age container
+func (e *Encrypted) Close() error {
+	err := e.PackerCloser.Close()
+	if err != nil {
+		return err
+	}
+	return e.w.Close()
+}
@@ -0,0 +1,40 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// NewTarZst returns a packer writing a zstandard compressed tar archive to w
+func NewTarZst(w io.Writer) (*Tar, error) {
+	zw, err := zstd.NewWriter(w)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create zstd writer: %s", err)
+	}
+
+	return NewCompressedTar(zw), nil
+}
+
+// NewTarXz returns a packer writing an xz compressed tar archive to w
+func NewTarXz(w io.Writer) (*Tar, error) {
+	xw, err := xz.NewWriter(w)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create xz writer: %s", err)
+	}
+
+	return NewCompressedTar(xw), nil
+}
+
+// NewTarBz2 returns a packer writing a bzip2 compressed tar archive to w
+func NewTarBz2(w io.Writer) (*Tar, error) {
+	bw, err := bzip2.NewWriter(w, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create bzip2 writer: %s", err)
+	}
+
+	return NewCompressedTar(bw), nil
+}
@@ -0,0 +1,243 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// zeros are written in place of file contents while laying out archives
+var zeros = make([]byte, 1<<20)
+
+// Archive is an archive with a known size, allowing random access
+type Archive interface {
+	io.ReadSeekCloser
+
+	// ETag identifies the contents of the archive
+	ETag() string
+
+	// ModTime is when the archive last changed
+	ModTime() time.Time
+}
+
+// Layout records the bytes of an archive written by a predictable format,
+// leaving out the contents of files - the archive can then be read with
+// random access, fetching file contents as needed
+//
+//	l := &Layout{}
+//	p, _ := format.New(l)
+//	p.File("name", 0644, size, l.Contents("key", size))
+type Layout struct {
+	Segments []Segment
+
+	// Size is the total size of the archive
+	Size int64
+
+	// remaining bytes of the current file contents
+	remaining int64
+}
+
+// Segment is either bytes of the archive itself or the contents of a file
+type Segment struct {
+	Offset int64
+	Length int64
+
+	// Data holds archive bytes, it is nil for file contents
+	Data []byte
+
+	// Key identifies file contents, as given to Contents
+	Key string
+}
+
+// Write records archive bytes, or counts file contents
+func (l *Layout) Write(p []byte) (int, error) {
+	n := len(p)
+
+	if l.remaining > 0 {
+		skip := min(int64(len(p)), l.remaining)
+		l.remaining -= skip
+		l.Size += skip
+		p = p[skip:]
+	}
+
+	if len(p) == 0 {
+		return n, nil
+	}
+
+	// extend the last segment if it holds archive bytes
+	last := len(l.Segments) - 1
+	if last < 0 || l.Segments[last].Data == nil {
+		l.Segments = append(l.Segments, Segment{Offset: l.Size})
+		last++
+	}
+
+	l.Segments[last].Data = append(l.Segments[last].Data, p...)
+	l.Segments[last].Length += int64(len(p))
+	l.Size += int64(len(p))
+
+	return n, nil
+}
+
+// Contents returns a reader to give the packer in place of the contents of a
+// file - the next size bytes written by the packer are taken as its contents
+func (l *Layout) Contents(key string, size int64) io.Reader {
+	return &contents{layout: l, key: key, remaining: size}
+}
+
+// contents produces zeros in place of file contents
+type contents struct {
+	layout    *Layout
+	key       string
+	remaining int64
+	started   bool
+}
+
+// start marks the beginning of the file contents - packers have written
+// the header of the file by the time they read its contents
+func (c *contents) start() {
+	if c.started {
+		return
+	}
+	c.started = true
+
+	if c.remaining == 0 {
+		return
+	}
+
+	c.layout.Segments = append(c.layout.Segments, Segment{
+		Offset: c.layout.Size,
+		Length: c.remaining,
+		Key:    c.key,
+	})
+	c.layout.remaining = c.remaining
+}
+
+func (c *contents) Read(p []byte) (int, error) {
+	c.start()
+
+	if c.remaining == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(p[:min(int64(len(p)), c.remaining)], zeros)
+	c.remaining -= int64(n)
+	return n, nil
+}
+
+// WriteTo writes zeros straight from a shared buffer, avoiding copies when
+// used by io.Copy
+func (c *contents) WriteTo(w io.Writer) (int64, error) {
+	c.start()
+
+	var written int64
+	for c.remaining > 0 {
+		n, err := w.Write(zeros[:min(int64(len(zeros)), c.remaining)])
+		written += int64(n)
+		c.remaining -= int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// Reader returns a reader of the archive, fetching file contents with open
+func (l *Layout) Reader(open func(key string, offset int64) (io.ReadCloser, error)) io.ReadSeekCloser {
+	return &layoutReader{layout: l, open: open}
+}
+
+// layoutReader reads an archive from its layout
+type layoutReader struct {
+	layout *Layout
+	open   func(key string, offset int64) (io.ReadCloser, error)
+	offset int64
+
+	// current file contents being read, and the offset it will read from next
+	current       io.ReadCloser
+	currentOffset int64
+}
+
+func (r *layoutReader) Read(p []byte) (int, error) {
+	if r.offset >= r.layout.Size {
+		return 0, io.EOF
+	}
+
+	// find the segment holding offset
+	segments := r.layout.Segments
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].Offset+segments[i].Length > r.offset
+	})
+	if i == len(segments) {
+		return 0, fmt.Errorf("layout has no segment at offset %d", r.offset)
+	}
+	s := segments[i]
+
+	within := r.offset - s.Offset
+	p = p[:min(int64(len(p)), s.Length-within)]
+
+	if s.Data != nil {
+		n := copy(p, s.Data[within:])
+		r.offset += int64(n)
+		return n, nil
+	}
+
+	if r.current == nil || r.currentOffset != r.offset {
+		r.closeCurrent()
+
+		rc, err := r.open(s.Key, within)
+		if err != nil {
+			return 0, err
+		}
+		r.current = rc
+		r.currentOffset = r.offset
+	}
+
+	n, err := r.current.Read(p)
+	r.offset += int64(n)
+	r.currentOffset += int64(n)
+
+	if errors.Is(err, io.EOF) {
+		r.closeCurrent()
+		if n == 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		err = nil
+	}
+
+	return n, err
+}
+
+func (r *layoutReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.layout.Size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset %d", offset)
+	}
+
+	r.offset = offset
+	return offset, nil
+}
+
+// closeCurrent closes the file contents being read, if any
+func (r *layoutReader) closeCurrent() {
+	if r.current != nil {
+		_ = r.current.Close()
+		r.current = nil
+	}
+}
+
+func (r *layoutReader) Close() error {
+	r.closeCurrent()
+	return nil
+}
@@ -0,0 +1,45 @@
+package packer
+
+import "os"
+
+// unix mode bits not covered by os.FileMode.Perm()
+const (
+	modeSetuid = 04000
+	modeSetgid = 02000
+	modeSticky = 01000
+)
+
+// UnixMode converts an os.FileMode into unix permission bits including
+// setuid, setgid and sticky bits
+func UnixMode(mode os.FileMode) uint32 {
+	m := uint32(mode.Perm())
+
+	if mode&os.ModeSetuid != 0 {
+		m |= modeSetuid
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= modeSetgid
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= modeSticky
+	}
+
+	return m
+}
+
+// FileMode converts unix permission bits, as found in scp commands, into an os.FileMode
+func FileMode(m uint32) os.FileMode {
+	mode := os.FileMode(m).Perm()
+
+	if m&modeSetuid != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&modeSetgid != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&modeSticky != 0 {
+		mode |= os.ModeSticky
+	}
+
+	return mode
+}
@@ -3,6 +3,7 @@ package packer
 import (
 	"io"
 	"os"
+	"time"
 )
 
 // Packer describes an interface used by the scp package to pack
@@ -18,3 +19,15 @@ type PackerCloser interface {
 	Packer
 	Close() error
 }
+
+// Timestamper is implemented by packers able to preserve file times
+// - the times given applies to the following call to File or Enter
+type Timestamper interface {
+	Times(modified, accessed time.Time)
+}
+
+// Checksummer is implemented by packers able to use a checksum known up front
+// - the CRC-32 (IEEE) given applies to the contents of the following call to File
+type Checksummer interface {
+	Checksum(crc uint32)
+}
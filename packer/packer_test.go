@@ -0,0 +1,357 @@
+package packer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/dsnet/compress/bzip2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// pack packs a small tree with an empty directory
+func pack(t *testing.T, p PackerCloser) {
+	steps := []func() error{
+		func() error { return p.Enter("root", 0755) },
+		func() error { return p.File("file.txt", 0644, 5, strings.NewReader("hello")) },
+		func() error { return p.Enter("empty", 0700) },
+		func() error { return p.Exit() },
+		func() error { return p.Exit() },
+		func() error { return p.Close() },
+	}
+
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("unable to pack: %s", err)
+		}
+	}
+}
+
+// TestFormats packs a tree with every registered format and unpacks it again
+func TestFormats(t *testing.T) {
+	decompressors := map[string]func(io.Reader) (io.Reader, error){
+		"tar":     func(r io.Reader) (io.Reader, error) { return r, nil },
+		"tar.gz":  func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"tar.zst": func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+		"tar.xz":  func(r io.Reader) (io.Reader, error) { return xz.NewReader(r) },
+		"tar.bz2": func(r io.Reader) (io.Reader, error) { return bzip2.NewReader(r, nil) },
+	}
+
+	expected := "root/ root/file.txt:hello root/empty/"
+
+	for _, f := range Formats() {
+		t.Run(f.Extension, func(t *testing.T) {
+			var buf bytes.Buffer
+			p, err := f.New(&buf)
+			if err != nil {
+				t.Fatalf("unable to create packer: %s", err)
+			}
+			pack(t, p)
+
+			var entries []string
+			if f.Extension == "zip" {
+				zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+				if err != nil {
+					t.Fatalf("unable to read zip: %s", err)
+				}
+				for _, file := range zr.File {
+					entries = append(entries, entry(t, file.Name, file.Open))
+				}
+			} else {
+				decompress, exists := decompressors[f.Extension]
+				if !exists {
+					t.Skipf("no way to unpack %s", f.Extension)
+				}
+
+				r, err := decompress(&buf)
+				if err != nil {
+					t.Fatalf("unable to decompress: %s", err)
+				}
+
+				tr := tar.NewReader(r)
+				for {
+					h, err := tr.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatalf("unable to read tar: %s", err)
+					}
+					entries = append(entries, entry(t, h.Name, func() (io.ReadCloser, error) { return io.NopCloser(tr), nil }))
+				}
+			}
+
+			if strings.Join(entries, " ") != expected {
+				t.Fatalf("unexpected entries: %q != %q", strings.Join(entries, " "), expected)
+			}
+		})
+	}
+}
+
+// entry formats an archive entry as name:content
+func entry(t *testing.T, name string, open func() (io.ReadCloser, error)) string {
+	if strings.HasSuffix(name, "/") {
+		return name
+	}
+
+	r, err := open()
+	if err != nil {
+		t.Fatalf("unable to open %s: %s", name, err)
+	}
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unable to read %s: %s", name, err)
+	}
+
+	return name + ":" + string(content)
+}
+
+// TestLayout lays out every predictable format and compares it with the archive itself
+func TestLayout(t *testing.T) {
+	files := map[string]string{
+		"small.txt": "hello",
+		"empty.txt": "",
+		// larger than the buffer of the zip writer
+		"large.bin": strings.Repeat("0123456789abcdef", 1<<10),
+	}
+	modified := time.Date(2020, 2, 2, 20, 20, 20, 0, time.UTC)
+
+	// packs files in a directory with contents from contents
+	packFiles := func(p PackerCloser, contents func(name string) io.Reader) {
+		p.(Timestamper).Times(modified, modified)
+		err := p.Enter("root", 0755)
+		for _, name := range []string{"small.txt", "empty.txt", "large.bin"} {
+			if err != nil {
+				break
+			}
+			p.(Timestamper).Times(modified, modified)
+			if c, ok := p.(Checksummer); ok {
+				c.Checksum(crc32.ChecksumIEEE([]byte(files[name])))
+			}
+			err = p.File(name, 0644, int64(len(files[name])), contents(name))
+		}
+		if err == nil {
+			err = p.Exit()
+		}
+		if err == nil {
+			err = p.Close()
+		}
+		if err != nil {
+			t.Fatalf("unable to pack: %s", err)
+		}
+	}
+
+	for _, f := range Formats() {
+		if !f.Predictable {
+			continue
+		}
+
+		t.Run(f.Extension, func(t *testing.T) {
+			var buf bytes.Buffer
+			p, err := f.New(&buf)
+			if err != nil {
+				t.Fatalf("unable to create packer: %s", err)
+			}
+			packFiles(p, func(name string) io.Reader { return strings.NewReader(files[name]) })
+
+			// entries written with a known checksum must be readable as well
+			if f.Extension == "zip" {
+				zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+				if err != nil {
+					t.Fatalf("unable to read zip: %s", err)
+				}
+				for _, file := range zr.File[1:] {
+					name := strings.TrimPrefix(file.Name, "root/")
+					if entry(t, file.Name, file.Open) != file.Name+":"+files[name] || !file.Modified.Equal(modified) {
+						t.Fatalf("wrong zip entry %s", file.Name)
+					}
+				}
+			}
+
+			layout := &Layout{}
+			p, err = f.New(layout)
+			if err != nil {
+				t.Fatalf("unable to create packer: %s", err)
+			}
+			packFiles(p, func(name string) io.Reader { return layout.Contents(name, int64(len(files[name]))) })
+
+			if layout.Size != int64(buf.Len()) {
+				t.Fatalf("wrong layout size: %d != %d", layout.Size, buf.Len())
+			}
+
+			r := layout.Reader(func(key string, offset int64) (io.ReadCloser, error) {
+				return io.NopCloser(strings.NewReader(files[key][offset:])), nil
+			})
+			defer r.Close()
+
+			// read the archive from somewhere in the middle of the large file
+			_, err = r.Seek(1000, io.SeekStart)
+			if err != nil {
+				t.Fatalf("unable to seek: %s", err)
+			}
+			tail, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("unable to read layout: %s", err)
+			}
+			if !bytes.Equal(tail, buf.Bytes()[1000:]) {
+				t.Fatalf("layout differs from archive")
+			}
+		})
+	}
+}
+
+// TestAESZip packs a tree encrypted with WinZip AES and decrypts it again
+func TestAESZip(t *testing.T) {
+	var buf bytes.Buffer
+	pack(t, NewAESZip(&buf, "secret"))
+
+	for _, password := range []string{"secret", "wrong"} {
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("unable to read zip: %s", err)
+		}
+		zr.RegisterDecompressor(winzipAES, func(r io.Reader) io.ReadCloser {
+			return io.NopCloser(decryptAES(t, r, password))
+		})
+
+		var entries []string
+		for _, file := range zr.File {
+			if strings.HasSuffix(file.Name, "/") {
+				entries = append(entries, file.Name)
+				continue
+			}
+
+			if file.Method != winzipAES || file.Flags&0x1 == 0 {
+				t.Fatalf("%s is not encrypted", file.Name)
+			}
+
+			r, err := file.Open()
+			var content []byte
+			if err == nil {
+				content, err = io.ReadAll(r)
+			}
+
+			if password == "wrong" {
+				if err == nil {
+					t.Fatalf("%s decrypted with a wrong password", file.Name)
+				}
+				continue
+			}
+
+			if err != nil {
+				t.Fatalf("unable to read %s: %s", file.Name, err)
+			}
+			entries = append(entries, file.Name+":"+string(content))
+		}
+
+		if password == "secret" && strings.Join(entries, " ") != "root/ root/file.txt:hello root/empty/" {
+			t.Fatalf("unexpected entries: %q", strings.Join(entries, " "))
+		}
+	}
+}
+
+func TestRaw(t *testing.T) {
+	var buf bytes.Buffer
+	var headers []string
+	raw := NewRaw(&buf, func(name string, _ os.FileMode, size int64) error {
+		headers = append(headers, fmt.Sprintf("%s:%d", name, size))
+		return nil
+	})
+
+	err := raw.File("file.txt", 0644, 5, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("unable to pack file: %s", err)
+	}
+
+	// the last byte is held back until it is known to be the only file
+	if buf.String() != "hell" {
+		t.Fatalf("unexpected contents before close: %q", buf.String())
+	}
+
+	err = raw.File("second.txt", 0644, 5, strings.NewReader("world"))
+	if !errors.Is(err, ErrMultipleFiles) {
+		t.Fatalf("expected ErrMultipleFiles, got %v", err)
+	}
+
+	err = raw.Close()
+	if !errors.Is(err, ErrMultipleFiles) {
+		t.Fatalf("expected close to fail with ErrMultipleFiles, got %v", err)
+	}
+	if buf.String() != "hell" || len(headers) != 1 {
+		t.Fatalf("several files written as %q with headers %q", buf.String(), headers)
+	}
+
+	buf.Reset()
+	raw = NewRaw(&buf, nil)
+	err = raw.File("file.txt", 0644, 5, strings.NewReader("hello"))
+	if err == nil {
+		err = raw.Close()
+	}
+	if err != nil || buf.String() != "hello" {
+		t.Fatalf("single file written as %q: %v", buf.String(), err)
+	}
+}
+
+// decryptAES decrypts a WinZip AES-256 entry as described by
+// https://www.winzip.com/en/support/aes-encryption/
+func decryptAES(t *testing.T, r io.Reader, password string) io.Reader {
+	data, err := io.ReadAll(r)
+	if err != nil || len(data) < 16+2+10 {
+		return iotest.ErrReader(fmt.Errorf("short entry: %v", err))
+	}
+
+	salt, verifier, contents, code := data[:16], data[16:18], data[18:len(data)-10], data[len(data)-10:]
+
+	keys, err := pbkdf2.Key(sha1.New, password, salt, 1000, 66)
+	if err != nil {
+		t.Fatalf("unable to derive keys: %s", err)
+	}
+	if !bytes.Equal(keys[64:], verifier) {
+		return iotest.ErrReader(errors.New("wrong password"))
+	}
+
+	mac := hmac.New(sha1.New, keys[32:64])
+	mac.Write(contents)
+	if !hmac.Equal(mac.Sum(nil)[:10], code) {
+		return iotest.ErrReader(errors.New("authentication failed"))
+	}
+
+	block, err := aes.NewCipher(keys[:32])
+	if err != nil {
+		t.Fatalf("unable to create cipher: %s", err)
+	}
+
+	plain := make([]byte, len(contents))
+	stream := make([]byte, aes.BlockSize)
+	for i := 0; i < len(contents); i += aes.BlockSize {
+		// the counter is a little endian number starting at 1
+		var counter [aes.BlockSize]byte
+		binary.LittleEndian.PutUint64(counter[:], uint64(i/aes.BlockSize+1))
+		block.Encrypt(stream, counter[:])
+
+		for j := i; j < len(contents) && j < i+aes.BlockSize; j++ {
+			plain[j] = contents[j] ^ stream[j-i]
+		}
+	}
+
+	return flate.NewReader(bytes.NewReader(plain))
+}
@@ -0,0 +1,111 @@
+package packer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+var (
+	// ErrDirectory is returned by Raw when asked to pack a directory
+	ErrDirectory = errors.New("upload contains a directory")
+
+	// ErrMultipleFiles is returned by Raw when asked to pack more than one file
+	ErrMultipleFiles = errors.New("upload contains more than one file")
+
+	// ErrNoFiles is returned by Raw when closed without having packed a file
+	ErrNoFiles = errors.New("upload contains no files")
+)
+
+// Raw writes the contents of a single file as is, without any archive around it
+//
+// The last byte of the file is held back until Raw is closed - if another file
+// shows up the download is left short of its length instead of looking complete
+type Raw struct {
+	w io.Writer
+
+	// header is called with name, mode and size of the file before its contents are written
+	header func(string, os.FileMode, int64) error
+
+	// packed is set once the file have been packed, written once its contents
+	// are being written
+	packed  bool
+	written bool
+
+	// last is the held back last byte of the file
+	last []byte
+
+	// err is the first error, the last byte is never written after one
+	err error
+}
+
+// NewRaw returns a packer writing a single file to w, header is called with
+// the name, mode and size of the file before its contents are written
+func NewRaw(w io.Writer, header func(string, os.FileMode, int64) error) *Raw {
+	return &Raw{w: w, header: header}
+}
+
+// Written reports whether any of the file have been written
+func (r *Raw) Written() bool {
+	return r.written
+}
+
+func (r *Raw) File(name string, mode os.FileMode, size int64, rd io.Reader) error {
+	if r.packed {
+		return r.fail(ErrMultipleFiles)
+	}
+
+	if r.header != nil {
+		err := r.header(name, mode, size)
+		if err != nil {
+			return err
+		}
+	}
+	r.packed = true
+
+	if size == 0 {
+		return nil
+	}
+
+	r.written = true
+	_, err := io.CopyN(r.w, rd, size-1)
+	if err == nil {
+		r.last = make([]byte, 1)
+		_, err = io.ReadFull(rd, r.last)
+	}
+	if err != nil {
+		return r.fail(fmt.Errorf("unable to copy file contents: %s", err))
+	}
+
+	return nil
+}
+
+func (r *Raw) Enter(string, os.FileMode) error {
+	return r.fail(ErrDirectory)
+}
+
+func (r *Raw) Exit() error {
+	return r.fail(ErrDirectory)
+}
+
+// fail records the first error
+func (r *Raw) fail(err error) error {
+	if r.err == nil {
+		r.err = err
+	}
+	return err
+}
+
+// Close writes the held back last byte of the file, unless packing failed
+func (r *Raw) Close() error {
+	if r.err != nil {
+		return r.err
+	}
+	if !r.packed {
+		return ErrNoFiles
+	}
+
+	_, err := r.w.Write(r.last)
+	return err
+}
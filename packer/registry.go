@@ -0,0 +1,121 @@
+package packer
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Format describes an archive format, formats are looked up by their extension
+type Format struct {
+	// Extension without the leading dot, e.g. "tar.gz"
+	Extension string
+
+	// MIMEType is used as Content-Type when serving the format
+	MIMEType string
+
+	// New returns a new packer writing the archive to w
+	New func(io.Writer) (PackerCloser, error)
+
+	// Predictable formats write file contents as is, their Layout is known
+	// from file names, modes, sizes and checksums alone
+	Predictable bool
+}
+
+var (
+	formatsMu sync.RWMutex
+	formats   []Format
+)
+
+func init() {
+	Register(Format{
+		Extension:   "zip",
+		MIMEType:    "application/zip",
+		New:         func(w io.Writer) (PackerCloser, error) { return NewZip(w), nil },
+		Predictable: true,
+	})
+	Register(Format{
+		Extension: "tar.gz",
+		MIMEType:  "application/gzip",
+		New:       func(w io.Writer) (PackerCloser, error) { return NewTarGz(w), nil },
+	})
+	Register(Format{
+		Extension:   "tar",
+		MIMEType:    "application/x-tar",
+		New:         func(w io.Writer) (PackerCloser, error) { return NewTar(w), nil },
+		Predictable: true,
+	})
+	Register(Format{
+		Extension: "tar.zst",
+		MIMEType:  "application/zstd",
+		New:       func(w io.Writer) (PackerCloser, error) { return NewTarZst(w) },
+	})
+	Register(Format{
+		Extension: "tar.xz",
+		MIMEType:  "application/x-xz",
+		New:       func(w io.Writer) (PackerCloser, error) { return NewTarXz(w) },
+	})
+	Register(Format{
+		Extension: "tar.bz2",
+		MIMEType:  "application/x-bzip2",
+		New:       func(w io.Writer) (PackerCloser, error) { return NewTarBz2(w) },
+	})
+}
+
+// Register makes a format available by its extension
+// - registering the same extension twice panics
+func Register(f Format) {
+	formatsMu.Lock()
+	defer formatsMu.Unlock()
+
+	if f.New == nil {
+		panic("packer: Register format without constructor")
+	}
+
+	for _, existing := range formats {
+		if existing.Extension == f.Extension {
+			panic(fmt.Sprintf("packer: Register called twice for extension %s", f.Extension))
+		}
+	}
+
+	formats = append(formats, f)
+}
+
+// Lookup finds a format by its extension
+func Lookup(extension string) (Format, bool) {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+
+	for _, f := range formats {
+		if f.Extension == extension {
+			return f, true
+		}
+	}
+
+	return Format{}, false
+}
+
+// Formats returns all registered formats in the order they where registered
+func Formats() []Format {
+	formatsMu.RLock()
+	defer formatsMu.RUnlock()
+
+	return append([]Format(nil), formats...)
+}
+
+// Extensions returns a human readable list of extensions, e.g. ".zip or .tar.gz"
+func Extensions() string {
+	all := Formats()
+
+	extensions := make([]string, len(all))
+	for i, f := range all {
+		extensions[i] = "." + f.Extension
+	}
+
+	if len(extensions) < 2 {
+		return strings.Join(extensions, "")
+	}
+
+	return strings.Join(extensions[:len(extensions)-1], ", ") + " or " + extensions[len(extensions)-1]
+}
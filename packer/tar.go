@@ -11,26 +11,72 @@ import (
 	"time"
 )
 
-type TarGz struct {
-	*gzip.Writer
+// Tar packs files into a tar archive, optionally compressed
+type Tar struct {
 	tar  *tar.Writer
 	Path string
+
+	// compressor is closed after the tar archive, nil for plain tar archives
+	compressor io.WriteCloser
+
+	// times for the next file or directory
+	modified, accessed time.Time
+}
+
+// NewTar returns a packer writing a plain tar archive to w
+func NewTar(w io.Writer) *Tar {
+	return &Tar{tar: tar.NewWriter(w)}
 }
 
-func NewTarGz(w io.Writer) *TarGz {
-	gzip := gzip.NewWriter(w)
-	return &TarGz{tar: tar.NewWriter(gzip), Writer: gzip}
+// NewCompressedTar returns a packer writing a tar archive through compressor,
+// the compressor is closed when the packer is closed
+func NewCompressedTar(compressor io.WriteCloser) *Tar {
+	return &Tar{tar: tar.NewWriter(compressor), compressor: compressor}
 }
 
-func (z *TarGz) File(name string, mode os.FileMode, size int64, r io.Reader) error {
-	err := z.tar.WriteHeader(&tar.Header{
+// NewTarGz returns a packer writing a gzip compressed tar archive to w
+func NewTarGz(w io.Writer) *Tar {
+	return NewCompressedTar(gzip.NewWriter(w))
+}
+
+// Times sets modified and accessed times of the next file or directory
+func (z *Tar) Times(modified, accessed time.Time) {
+	z.modified = modified
+	z.accessed = accessed
+}
+
+// header returns a header with times and mode set
+func (z *Tar) header(name string, mode os.FileMode) *tar.Header {
+	h := &tar.Header{
 		Name: path.Join(z.Path, name),
+		Mode: int64(UnixMode(mode)),
 
 		// We remove 5 seconds as the tar "file is in the future" is highly annoying
 		ModTime: time.Now().Add(time.Second * -5),
-		Mode:    int64(mode),
-		Size:    size,
-	})
+	}
+
+	if !z.modified.IsZero() {
+		h.ModTime = z.modified
+	}
+
+	// access times are only available in the PAX format
+	if !z.accessed.IsZero() {
+		h.AccessTime = z.accessed
+		h.Format = tar.FormatPAX
+	}
+
+	// times only apply once
+	z.modified = time.Time{}
+	z.accessed = time.Time{}
+
+	return h
+}
+
+func (z *Tar) File(name string, mode os.FileMode, size int64, r io.Reader) error {
+	h := z.header(name, mode)
+	h.Size = size
+
+	err := z.tar.WriteHeader(h)
 	if err != nil {
 		return fmt.Errorf("unable to create file: %s", err)
 	}
@@ -43,13 +89,24 @@ func (z *TarGz) File(name string, mode os.FileMode, size int64, r io.Reader) err
 	return nil
 }
 
-func (z *TarGz) Enter(name string, mode os.FileMode) error {
+func (z *Tar) Enter(name string, mode os.FileMode) error {
+	h := z.header(name, mode)
+	h.Typeflag = tar.TypeDir
+
+	// directories are recognized by their trailing slash
+	h.Name = h.Name + "/"
+
+	err := z.tar.WriteHeader(h)
+	if err != nil {
+		return fmt.Errorf("unable to create directory: %s", err)
+	}
+
 	z.Path = path.Join(z.Path, name)
 	z.Path = path.Clean(z.Path)
 	return nil
 }
 
-func (z *TarGz) Exit() error {
+func (z *Tar) Exit() error {
 	parts := strings.Split(z.Path, "/")
 
 	// if there was no path to split and we somehow received a directory leave
@@ -62,19 +119,25 @@ func (z *TarGz) Exit() error {
 	return nil
 }
 
-func (z *TarGz) Close() error {
+func (z *Tar) Close() error {
 	err := z.tar.Close()
 	if err != nil {
-		// ninja also close the gzip
-		z.Writer.Close()
+		// ninja also close the compressor
+		if z.compressor != nil {
+			z.compressor.Close()
+		}
 
 		return fmt.Errorf("could not close tar: %s", err)
 	}
 
-	// also Flush and close gzip
-	err = z.Writer.Close()
+	if z.compressor == nil {
+		return nil
+	}
+
+	// also Flush and close the compressor
+	err = z.compressor.Close()
 	if err != nil {
-		return fmt.Errorf("could not close gzip: %s", err)
+		return fmt.Errorf("could not close compressor: %s", err)
 	}
 
 	return nil
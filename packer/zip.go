@@ -2,6 +2,7 @@ package packer
 
 import (
 	"archive/zip"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"os"
@@ -13,17 +14,71 @@ import (
 type Zip struct {
 	*zip.Writer
 	Path string
+
+	// modification time of the next file or directory
+	modified time.Time
+
+	// checksum of the next file, if known
+	crc      uint32
+	checksum bool
+
+	// encrypted files are written with WinZip AES, see NewAESZip
+	encrypted bool
 }
 
 func NewZip(w io.Writer) *Zip {
 	return &Zip{Writer: zip.NewWriter(w)}
 }
 
-func (z *Zip) File(name string, mode os.FileMode, _ int64, r io.Reader) error {
-	fd, err := z.CreateHeader(&zip.FileHeader{
+// Times sets the modification time of the next file or directory
+// - zip files have no notion of access times
+func (z *Zip) Times(modified, _ time.Time) {
+	z.modified = modified
+}
+
+// header returns a header with modification time and mode set
+func (z *Zip) header(name string, mode os.FileMode) *zip.FileHeader {
+	h := &zip.FileHeader{
 		Name:     path.Join(z.Path, name),
 		Modified: time.Now(),
-	})
+	}
+
+	if !z.modified.IsZero() {
+		h.Modified = z.modified
+	}
+	z.modified = time.Time{}
+
+	// SetMode also marks the file as created on unix
+	h.SetMode(mode)
+
+	return h
+}
+
+// Checksum sets the CRC-32 of the next file, allowing its sizes and checksum
+// to be written ahead of its contents
+func (z *Zip) Checksum(crc uint32) {
+	z.crc = crc
+	z.checksum = true
+}
+
+func (z *Zip) File(name string, mode os.FileMode, size int64, r io.Reader) error {
+	var fd io.Writer
+	var err error
+
+	h := z.header(name, mode)
+	switch {
+	case z.encrypted:
+		// the contents are compressed by the encrypting compressor
+		h.Method = winzipAES
+		h.Flags |= 0x1
+		h.Extra = append(h.Extra, aesExtra...)
+		z.checksum = false
+		fd, err = z.CreateHeader(h)
+	case z.checksum:
+		fd, err = z.raw(h, size)
+	default:
+		fd, err = z.CreateHeader(h)
+	}
 	if err != nil {
 		return fmt.Errorf("unable to create file: %s", err)
 	}
@@ -36,7 +91,50 @@ func (z *Zip) File(name string, mode os.FileMode, _ int64, r io.Reader) error {
 	return nil
 }
 
+// raw creates a stored entry without data descriptor, as the checksum is known
+func (z *Zip) raw(h *zip.FileHeader, size int64) (io.Writer, error) {
+	h.Method = zip.Store
+	h.CRC32 = z.crc
+	h.CompressedSize64 = uint64(size)
+	h.UncompressedSize64 = uint64(size)
+	z.checksum = false
+
+	// CreateRaw leaves the modification time to us, do as CreateHeader does
+	t := h.Modified
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+	h.ModifiedDate = uint16(t.Day() + int(t.Month())<<5 + (t.Year()-1980)<<9)
+	h.ModifiedTime = uint16(t.Second()/2 + t.Minute()<<5 + t.Hour()<<11)
+
+	// extended timestamp, as used by Info-ZIP
+	extra := make([]byte, 9)
+	binary.LittleEndian.PutUint16(extra[0:], 0x5455)
+	binary.LittleEndian.PutUint16(extra[2:], 5)
+	extra[4] = 1
+	binary.LittleEndian.PutUint32(extra[5:], uint32(h.Modified.Unix()))
+	h.Extra = append(h.Extra, extra...)
+
+	w, err := z.CreateRaw(h)
+	if err != nil {
+		return nil, err
+	}
+
+	// headers must reach the underlying writer before any contents, see Layout
+	return w, z.Flush()
+}
+
 func (z *Zip) Enter(name string, mode os.FileMode) error {
+	h := z.header(name, mode|os.ModeDir)
+
+	// directories are recognized by their trailing slash
+	h.Name = h.Name + "/"
+
+	_, err := z.CreateHeader(h)
+	if err != nil {
+		return fmt.Errorf("unable to create directory: %s", err)
+	}
+
 	z.Path = path.Join(z.Path, name)
 	z.Path = path.Clean(z.Path)
 	return nil
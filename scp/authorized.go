@@ -0,0 +1,319 @@
+package scp
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+func init() {
+	// an OpenSSH authorized_keys file, when set only its keys are allowed to log in
+	viper.SetDefault("AUTHORIZED_KEYS", "")
+}
+
+// permissions extensions set when a key is authorized
+const (
+	fingerprintExtension = "fingerprint"
+	quotaExtension       = "quota"
+	maxTTLExtension      = "max-ttl"
+)
+
+// authorizedKey is a key from the authorized_keys file and its options
+type authorizedKey struct {
+	// quota is the maximum number of bytes of each transfer, 0 means no limit
+	quota int64
+
+	// maxTTL is the longest a transfer may be kept, 0 means no limit
+	maxTTL time.Duration
+
+	// from is a comma separated list of address patterns the key must be used from
+	from string
+}
+
+// authorizedKeys checks public keys against an authorized_keys file, the file
+// is read again when it changes
+type authorizedKeys struct {
+	sync.Mutex
+
+	path     string
+	modified time.Time
+	size     int64
+
+	// keys are indexed by their wire format
+	keys map[string]authorizedKey
+}
+
+// newAuthorizedKeys reads the authorized_keys file at path
+func newAuthorizedKeys(path string) (*authorizedKeys, error) {
+	a := &authorizedKeys{path: path}
+
+	err := a.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// reload reads the file if it have changed since it was last read
+func (a *authorizedKeys) reload() error {
+	fi, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+
+	if a.keys != nil && fi.ModTime().Equal(a.modified) && fi.Size() == a.size {
+		return nil
+	}
+
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]authorizedKey)
+	for len(bytes.TrimSpace(data)) > 0 {
+		var key ssh.PublicKey
+		var options []string
+
+		key, _, options, data, err = ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			// nothing but comments and empty lines remains
+			break
+		}
+
+		k, err := parseKeyOptions(options)
+		if err != nil {
+			log.Printf("Authorized keys: skipping %s: %s", ssh.FingerprintSHA256(key), err)
+			continue
+		}
+
+		keys[string(key.Marshal())] = k
+	}
+
+	log.Printf("Authorized keys: read %d keys from %s", len(keys), a.path)
+
+	a.keys = keys
+	a.modified = fi.ModTime()
+	a.size = fi.Size()
+	return nil
+}
+
+// parseKeyOptions reads the options of a key, options meant for sshd are ignored
+func parseKeyOptions(options []string) (authorizedKey, error) {
+	var k authorizedKey
+
+	for _, option := range options {
+		name, value, _ := strings.Cut(option, "=")
+		value = strings.Trim(value, `"`)
+
+		switch strings.ToLower(name) {
+		case "quota":
+			n, err := parseSize(value)
+			if err != nil {
+				return k, fmt.Errorf("quota: %w", err)
+			}
+			k.quota = n
+
+		case "max-ttl":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return k, fmt.Errorf("max-ttl: %q is not a positive duration", value)
+			}
+			k.maxTTL = d
+
+		case "from":
+			k.from = value
+		}
+	}
+
+	return k, nil
+}
+
+// parseSize parses a number of bytes with an optional K, M, G or T suffix
+func parseSize(s string) (int64, error) {
+	multiplier := int64(1)
+	if i := strings.IndexAny(s, "KMGTkmgt"); i >= 0 && i == len(s)-1 {
+		multiplier = 1 << (10 * (strings.Index("KMGT", strings.ToUpper(s[i:])) + 1))
+		s = s[:i]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%q is not a positive size, such as 10G", s)
+	}
+
+	return n * multiplier, nil
+}
+
+// check is an ssh.PublicKeyCallback allowing keys of the authorized_keys file
+func (a *authorizedKeys) check(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	a.Lock()
+	err := a.reload()
+	if err != nil {
+		log.Printf("Authorized keys: unable to reload %s: %s", a.path, err)
+	}
+	k, exists := a.keys[string(key.Marshal())]
+	a.Unlock()
+
+	fingerprint := ssh.FingerprintSHA256(key)
+	if !exists {
+		return nil, fmt.Errorf("%s is not authorized", fingerprint)
+	}
+
+	if k.from != "" && !matchAddress(meta.RemoteAddr(), k.from) {
+		log.Printf("Authorized keys: %s is not allowed from %s", fingerprint, meta.RemoteAddr())
+		return nil, fmt.Errorf("%s is not allowed from %s", fingerprint, meta.RemoteAddr())
+	}
+
+	return &ssh.Permissions{Extensions: map[string]string{
+		fingerprintExtension: fingerprint,
+		quotaExtension:       strconv.FormatInt(k.quota, 10),
+		maxTTLExtension:      k.maxTTL.String(),
+	}}, nil
+}
+
+// RequireKeys only allows keys of the keysFile authorized_keys file, and
+// certificates signed by the key in caFile for principals, to log in - if
+// either is given. It must be called before Listen.
+func (s *Server) RequireKeys(keysFile, caFile string, principals []string) error {
+	return requireKeys(s.sshConfig, keysFile, caFile, principals)
+}
+
+// requireKeys only allows keys of the authorized_keys file, and certificates
+// of trusted authorities, to log in - if either is given
+func requireKeys(config *ssh.ServerConfig, keysFile, caFile string, principals []string) error {
+	var keys *authorizedKeys
+	var ca *userCA
+	var err error
+
+	if keysFile != "" {
+		keys, err = newAuthorizedKeys(keysFile)
+		if err != nil {
+			return fmt.Errorf("authorized keys: %w", err)
+		}
+	}
+
+	if caFile != "" {
+		ca, err = newUserCA(caFile, principals)
+		if err != nil {
+			return fmt.Errorf("user ca: %w", err)
+		}
+	}
+
+	if keys == nil && ca == nil {
+		return nil
+	}
+
+	// the password prompt is only offered once the key is verified
+	config.NoClientAuth = false
+	config.NoClientAuthCallback = nil
+	config.KeyboardInteractiveCallback = nil
+	config.VerifiedPublicKeyCallback = verified
+	config.PublicKeyCallback = func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if _, ok := key.(*ssh.Certificate); ok && ca != nil {
+			return ca.check(meta, key)
+		}
+
+		if keys == nil {
+			return nil, fmt.Errorf("%s is not a certificate", ssh.FingerprintSHA256(key))
+		}
+		return keys.check(meta, key)
+	}
+
+	return nil
+}
+
+// verified prompts uploaders asking for it for a download password, once their
+// key have been verified
+func verified(meta ssh.ConnMetadata, _ ssh.PublicKey, permissions *ssh.Permissions, _ string) (*ssh.Permissions, error) {
+	options, err := ParseOptions(meta.User())
+	if err != nil || !options.AskPassword {
+		return permissions, nil
+	}
+
+	return nil, &ssh.PartialSuccessError{Next: ssh.ServerAuthCallbacks{
+		KeyboardInteractiveCallback: func(meta ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			p, err := askPassword(meta, client)
+			if err != nil {
+				return nil, err
+			}
+
+			for k, v := range permissions.Extensions {
+				p.Extensions[k] = v
+			}
+			return p, nil
+		},
+	}}
+}
+
+// matchAddress reports whether the ip of addr matches the comma separated patterns,
+// as the from= option of OpenSSH: wildcards, CIDR and ! to negate - host names
+// are not looked up
+func matchAddress(addr net.Addr, patterns string) bool {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+
+	matched := false
+	for _, pattern := range strings.Split(patterns, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		var match bool
+		if _, network, err := net.ParseCIDR(pattern); err == nil {
+			match = ip != nil && network.Contains(ip)
+		} else {
+			match, _ = path.Match(pattern, host)
+		}
+
+		if match && negated {
+			return false
+		}
+		matched = matched || match
+	}
+
+	return matched
+}
+
+// fingerprint returns the fingerprint of the key the client logged in with, if any
+func (c *connection) fingerprint() string {
+	if c.Permissions == nil {
+		return ""
+	}
+	return c.Permissions.Extensions[fingerprintExtension]
+}
+
+// limits returns the quota and maximum ttl of the key the client logged in with
+func (c *connection) limits() (int64, time.Duration) {
+	if c.Permissions == nil {
+		return 0, 0
+	}
+
+	quota, _ := strconv.ParseInt(c.Permissions.Extensions[quotaExtension], 10, 64)
+	maxTTL, _ := time.ParseDuration(c.Permissions.Extensions[maxTTLExtension])
+	return quota, maxTTL
+}
+
+// String describes the client by address and, if known, key fingerprint and certificate key id
+func (c *connection) String() string {
+	if keyID := c.keyID(); keyID != "" {
+		return fmt.Sprintf("%s (%s, key id %q)", c.RemoteAddr(), c.fingerprint(), keyID)
+	}
+	if fingerprint := c.fingerprint(); fingerprint != "" {
+		return fmt.Sprintf("%s (%s)", c.RemoteAddr(), fingerprint)
+	}
+	return c.RemoteAddr().String()
+}
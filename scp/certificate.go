@@ -0,0 +1,175 @@
+package scp
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/fasmide/hostkeys"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+func init() {
+	// a file of certificate authority public keys, when set certificates signed
+	// by them are allowed to log in
+	viper.SetDefault("USER_CA", "")
+
+	// comma separated principals of which certificates must have at least one,
+	// when empty any principal is accepted
+	viper.SetDefault("USER_CA_PRINCIPALS", "")
+}
+
+// permissions extensions set when a certificate is authorized
+const (
+	keyIDExtension      = "key-id"
+	principalsExtension = "principals"
+)
+
+// userCA checks user certificates against trusted certificate authorities
+type userCA struct {
+	checker ssh.CertChecker
+
+	// principals of which certificates must have at least one
+	principals []string
+}
+
+// newUserCA reads certificate authority public keys from the file at path
+func newUserCA(file string, principals []string) (*userCA, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	authorities := make(map[string]bool)
+	for len(strings.TrimSpace(string(data))) > 0 {
+		var key ssh.PublicKey
+
+		key, _, _, data, err = ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		authorities[string(key.Marshal())] = true
+	}
+
+	if len(authorities) == 0 {
+		return nil, fmt.Errorf("no certificate authorities found in %s", file)
+	}
+
+	u := &userCA{principals: principals}
+	u.checker.IsUserAuthority = func(auth ssh.PublicKey) bool {
+		return authorities[string(auth.Marshal())]
+	}
+
+	return u, nil
+}
+
+// principalMeta reports principal as the user, as usernames are options to us
+type principalMeta struct {
+	ssh.ConnMetadata
+	principal string
+}
+
+func (p principalMeta) User() string {
+	return p.principal
+}
+
+// check is an ssh.PublicKeyCallback allowing certificates signed by a trusted
+// authority, which are valid right now and have one of the required principals
+func (u *userCA) check(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", ssh.FingerprintSHA256(key))
+	}
+
+	principals := u.principals
+	if len(principals) == 0 {
+		// any principal of the certificate will do, certificates without
+		// principals are valid for anyone
+		principals = []string{""}
+		if len(cert.ValidPrincipals) > 0 {
+			principals = cert.ValidPrincipals[:1]
+		}
+	}
+
+	var err error
+	for _, principal := range principals {
+		var permissions *ssh.Permissions
+
+		permissions, err = u.checker.Authenticate(principalMeta{ConnMetadata: meta, principal: principal}, cert)
+		if err != nil {
+			continue
+		}
+
+		if permissions.Extensions == nil {
+			permissions.Extensions = make(map[string]string)
+		}
+		permissions.Extensions[fingerprintExtension] = ssh.FingerprintSHA256(cert.Key)
+		permissions.Extensions[keyIDExtension] = cert.KeyId
+		permissions.Extensions[principalsExtension] = strings.Join(cert.ValidPrincipals, ",")
+		return permissions, nil
+	}
+
+	return nil, fmt.Errorf("certificate %q is not authorized: %w", cert.KeyId, err)
+}
+
+// hostCertificates offers certificates of the host keys managed by m, OpenSSH
+// style certificates are read from files named as the key with -cert.pub appended
+func hostCertificates(m *hostkeys.Manager, config *ssh.ServerConfig) error {
+	for _, k := range m.Keys {
+		keyFile := path.Join(m.Directory, fmt.Sprintf(m.NamingScheme, k.Name()))
+
+		data, err := os.ReadFile(keyFile + "-cert.pub")
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		public, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return fmt.Errorf("%s-cert.pub: %w", keyFile, err)
+		}
+		cert, ok := public.(*ssh.Certificate)
+		if !ok {
+			return fmt.Errorf("%s-cert.pub is not a certificate", keyFile)
+		}
+
+		private, err := os.ReadFile(keyFile)
+		if err != nil {
+			return err
+		}
+		signer, err := ssh.ParsePrivateKey(private)
+		if err != nil {
+			return err
+		}
+
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			return fmt.Errorf("%s-cert.pub: %w", keyFile, err)
+		}
+
+		// the plain key remains, for clients not trusting the authority
+		config.AddHostKey(certSigner)
+	}
+
+	return nil
+}
+
+// keyID returns the key id of the certificate the client logged in with, if any
+func (c *connection) keyID() string {
+	if c.Permissions == nil {
+		return ""
+	}
+	return c.Permissions.Extensions[keyIDExtension]
+}
+
+// principals returns the principals of the certificate the client logged in with, if any
+func (c *connection) principals() []string {
+	if c.Permissions == nil || c.Permissions.Extensions[principalsExtension] == "" {
+		return nil
+	}
+	return strings.Split(c.Permissions.Extensions[principalsExtension], ",")
+}
@@ -0,0 +1,35 @@
+package scp
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+// connection is a connected ssh client
+type connection struct {
+	*ssh.ServerConn
+
+	// done is closed once the client disconnects
+	done chan struct{}
+}
+
+// newConnection wraps an ssh connection and keeps track of when it is closed
+func newConnection(c *ssh.ServerConn) *connection {
+	conn := &connection{ServerConn: c, done: make(chan struct{})}
+
+	go func() {
+		_ = c.Wait()
+		close(conn.done)
+	}()
+
+	return conn
+}
+
+// Connected reports whether the client is still connected
+func (c *connection) Connected() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+		return true
+	}
+}
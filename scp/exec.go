@@ -0,0 +1,196 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrNotSCP is returned for commands other than scp
+	ErrNotSCP = errors.New("only scp is supported")
+
+	// ErrUnterminatedQuote is returned for command lines with an unterminated quote
+	ErrUnterminatedQuote = errors.New("unterminated quote")
+)
+
+// execRequest is the payload of exec requests, see RFC 4254 section 6.5
+type execRequest struct {
+	Command string
+}
+
+// subsystemRequest is the payload of subsystem requests
+type subsystemRequest struct {
+	Name string
+}
+
+// scpCommand is scp as run on our side of the connection by scp clients, e.g.
+// scp -v -r -d -t -- some-target
+type scpCommand struct {
+	// To is set by -t, the client sends files to us
+	To bool
+
+	// From is set by -f, the client fetches files from us
+	From bool
+
+	// Recursive, Directory, Preserve and Verbose are set by -r, -d, -p and -v
+	Recursive bool
+	Directory bool
+	Preserve  bool
+	Verbose   bool
+
+	// Paths are the arguments after the flags, the target of -t or the sources of -f
+	Paths []string
+}
+
+// parseExec parses the payload of an exec request as an scp command line
+func parseExec(payload []byte) (*scpCommand, error) {
+	var req execRequest
+	err := ssh.Unmarshal(payload, &req)
+	if err != nil {
+		return nil, fmt.Errorf("malformed exec request: %w", err)
+	}
+
+	args, err := splitCommand(req.Command)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSCP(args)
+}
+
+// parseSCP interprets the flags of scp the way OpenSSH does, flags may be
+// combined as in -rt and end at the first argument which is not a flag, or at --
+func parseSCP(args []string) (*scpCommand, error) {
+	if len(args) == 0 || path.Base(args[0]) != "scp" {
+		return nil, ErrNotSCP
+	}
+
+	c := &scpCommand{}
+	i := 1
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			break
+		}
+
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 't':
+				c.To = true
+			case 'f':
+				c.From = true
+			case 'r':
+				c.Recursive = true
+			case 'd':
+				c.Directory = true
+			case 'p':
+				c.Preserve = true
+			case 'v':
+				c.Verbose = true
+			default:
+				return nil, fmt.Errorf("scp: unsupported flag -%c", flag)
+			}
+		}
+	}
+	c.Paths = args[i:]
+
+	switch {
+	case c.To == c.From:
+		return nil, errors.New("scp: either -t or -f is required")
+	case c.To && len(c.Paths) > 1:
+		return nil, errors.New("scp: ambiguous target")
+	case c.From && len(c.Paths) != 1:
+		return nil, errors.New("scp: fetch a single id at a time")
+	}
+
+	return c, nil
+}
+
+// Target returns the target path of -t, or "" if there is none
+func (c *scpCommand) Target() string {
+	if !c.To || len(c.Paths) == 0 {
+		return ""
+	}
+	return c.Paths[0]
+}
+
+// splitCommand splits a command line into arguments as a POSIX shell does,
+// without expanding anything: arguments are separated by blanks, single quotes
+// keep everything as is and backslashes escape the next character - inside
+// double quotes only $, `, ", \ and newlines
+func splitCommand(command string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+
+	// inArg is set once an argument have started, even if it is empty as in ''
+	inArg := false
+
+	for i := 0; i < len(command); i++ {
+		ch := command[i]
+
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+
+		case ch == '\\':
+			inArg = true
+			if i+1 < len(command) {
+				i++
+				// a backslash newline continues the line
+				if command[i] != '\n' {
+					arg.WriteByte(command[i])
+				}
+			}
+
+		case ch == '\'':
+			inArg = true
+			end := strings.IndexByte(command[i+1:], '\'')
+			if end < 0 {
+				return nil, ErrUnterminatedQuote
+			}
+			arg.WriteString(command[i+1 : i+1+end])
+			i += end + 1
+
+		case ch == '"':
+			inArg = true
+			closed := false
+			for i++; i < len(command); i++ {
+				if command[i] == '"' {
+					closed = true
+					break
+				}
+				if command[i] == '\\' && i+1 < len(command) && strings.IndexByte("$`\"\\\n", command[i+1]) >= 0 {
+					i++
+					if command[i] == '\n' {
+						continue
+					}
+				}
+				arg.WriteByte(command[i])
+			}
+			if !closed {
+				return nil, ErrUnterminatedQuote
+			}
+
+		default:
+			inArg = true
+			arg.WriteByte(ch)
+		}
+	}
+
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
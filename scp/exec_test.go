@@ -0,0 +1,99 @@
+package scp
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		command string
+		args    []string
+		err     error
+	}{
+		{command: "scp -t .", args: []string{"scp", "-t", "."}},
+		{command: "  scp\t-t \n release.zip ", args: []string{"scp", "-t", "release.zip"}},
+		{command: `scp -t 'my release.zip'`, args: []string{"scp", "-t", "my release.zip"}},
+		{command: `scp -t "my \"new\" \$release"`, args: []string{"scp", "-t", `my "new" $release`}},
+		{command: `scp -t "a\b"`, args: []string{"scp", "-t", `a\b`}},
+		{command: `scp -t my\ release\'s`, args: []string{"scp", "-t", "my release's"}},
+		{command: `scp -t ''`, args: []string{"scp", "-t", ""}},
+		{command: `scp -t it'"s'"'"`, args: []string{"scp", "-t", `it"s'`}},
+		{command: `scp -t 'release`, err: ErrUnterminatedQuote},
+		{command: `scp -t "release`, err: ErrUnterminatedQuote},
+	}
+
+	for _, test := range tests {
+		args, err := splitCommand(test.command)
+		if !errors.Is(err, test.err) {
+			t.Fatalf("%q: expected %v, got %v", test.command, test.err, err)
+		}
+		if err == nil && !reflect.DeepEqual(args, test.args) {
+			t.Fatalf("%q: split as %q", test.command, args)
+		}
+	}
+}
+
+func TestParseExec(t *testing.T) {
+	tests := []struct {
+		command string
+		scp     *scpCommand
+		target  string
+	}{
+		{
+			command: "scp -v -r -d -t -- -f.zip",
+			scp:     &scpCommand{To: true, Verbose: true, Recursive: true, Directory: true, Paths: []string{"-f.zip"}},
+			target:  "-f.zip",
+		},
+		{
+			command: "scp -prt release-t.zip",
+			scp:     &scpCommand{To: true, Preserve: true, Recursive: true, Paths: []string{"release-t.zip"}},
+			target:  "release-t.zip",
+		},
+		{
+			command: "/usr/bin/scp -t",
+			scp:     &scpCommand{To: true, Paths: []string{}},
+		},
+		{
+			command: "scp -r -f some-id/-t",
+			scp:     &scpCommand{From: true, Recursive: true, Paths: []string{"some-id/-t"}},
+		},
+		{command: "ls -t"},
+		{command: "scp -r ."},
+		{command: "scp -t -f ."},
+		{command: "scp -x -t ."},
+		{command: "scp -t one two"},
+		{command: "scp -f one two"},
+		{command: "scp -t 'release"},
+	}
+
+	for _, test := range tests {
+		payload := ssh.Marshal(&execRequest{Command: test.command})
+
+		c, err := parseExec(payload)
+		if test.scp == nil {
+			if err == nil {
+				t.Fatalf("%q: parsed as %+v", test.command, c)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", test.command, err)
+		}
+
+		if !reflect.DeepEqual(c, test.scp) {
+			t.Fatalf("%q: parsed as %+v", test.command, c)
+		}
+		if c.Target() != test.target {
+			t.Fatalf("%q: wrong target %q", test.command, c.Target())
+		}
+	}
+
+	_, err := parseExec([]byte{0, 0, 0, 9, 's', 'c', 'p'})
+	if err == nil {
+		t.Fatalf("truncated payload was parsed")
+	}
+}
@@ -0,0 +1,350 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fasmide/schttp/packer"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	// how long a fanout sink waits for more downloaders after the first one
+	viper.SetDefault("FANOUT_GRACE", "30s")
+
+	// how long the upload waits on a downloader which is not keeping up,
+	// before the downloader is dropped
+	viper.SetDefault("FANOUT_TIMEOUT", "30s")
+}
+
+var (
+	// ErrSlowDownloader is returned to downloaders dropped for not keeping up
+	ErrSlowDownloader = errors.New("downloader too slow, dropped")
+
+	// ErrNoDownloaders is returned when every downloader of a fanout sink is gone
+	ErrNoDownloaders = errors.New("every downloader is gone")
+
+	// errUploadFailed is returned to downloaders when the upload fails
+	errUploadFailed = errors.New("upload failed")
+)
+
+// fanoutBuffer is the number of chunks buffered for each downloader
+const fanoutBuffer = 16
+
+// fanoutChunk is the size of chunks of file contents sent to downloaders
+const fanoutChunk = 32 << 10
+
+// fanout serves a sink to several downloaders at once, it implements packer.PackerCloser
+// by replaying every call on the packers of its members
+type fanout struct {
+	sync.Mutex
+
+	sink *Sink
+
+	// size is the number of downloaders to wait for
+	size int
+
+	// grace is how long to wait for more downloaders after the first one
+	grace time.Duration
+
+	// timeout is how long a downloader may block the upload
+	timeout time.Duration
+
+	members []*member
+	started bool
+
+	// onStart is called once no more downloaders may join
+	onStart func()
+}
+
+// newFanout returns a fanout of sink for size downloaders
+func newFanout(sink *Sink, size int, onStart func()) *fanout {
+	return &fanout{
+		sink:    sink,
+		size:    size,
+		grace:   viper.GetDuration("FANOUT_GRACE"),
+		timeout: viper.GetDuration("FANOUT_TIMEOUT"),
+		onStart: onStart,
+	}
+}
+
+// join adds a downloader, the upload starts once every downloader have joined
+// or the grace period after the first one have passed
+func (f *fanout) join() (*member, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.started {
+		return nil, fmt.Errorf("%s does not exist", f.sink.ID)
+	}
+
+	m := &member{
+		fanout:    f,
+		remaining: f.size - len(f.members) - 1,
+		items:     make(chan item, fanoutBuffer),
+		gone:      make(chan struct{}),
+	}
+	f.members = append(f.members, m)
+
+	switch len(f.members) {
+	case f.size:
+		f.start()
+	case 1:
+		time.AfterFunc(f.grace, func() {
+			f.Lock()
+			defer f.Unlock()
+			f.start()
+		})
+	}
+
+	return m, nil
+}
+
+// remaining returns how many downloaders may join after the next one
+func (f *fanout) remaining() int {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.size - len(f.members) - 1
+}
+
+// joined reports whether any downloader have joined
+func (f *fanout) joined() bool {
+	f.Lock()
+	defer f.Unlock()
+
+	return len(f.members) > 0
+}
+
+// start starts the upload - must be called with the lock held
+func (f *fanout) start() {
+	if f.started {
+		return
+	}
+	f.started = true
+
+	log.Printf("Fanout of sink %s to %d downloaders", f.sink.ID, len(f.members))
+
+	go func() {
+		f.onStart()
+
+		err := f.sink.PackTo(f)
+		if err != nil {
+			log.Printf("Fanout of sink %s failed: %s", f.sink.ID, err)
+		}
+	}()
+}
+
+// send hands an item to a member, dropping the member if it does not accept
+// the item within the timeout
+func (f *fanout) send(m *member, it item) bool {
+	select {
+	case m.items <- it:
+		return true
+	case <-m.gone:
+		return false
+	default:
+	}
+
+	timer := time.NewTimer(f.timeout)
+	defer timer.Stop()
+
+	select {
+	case m.items <- it:
+		return true
+	case <-m.gone:
+		return false
+	case <-timer.C:
+		log.Printf("Fanout of sink %s: dropping slow downloader", f.sink.ID)
+		m.fail(ErrSlowDownloader)
+		return false
+	}
+}
+
+// each sends an item to every member still here
+func (f *fanout) each(it item) error {
+	alive := 0
+	for _, m := range f.members {
+		if f.send(m, it) {
+			alive++
+		}
+	}
+
+	if alive == 0 {
+		return ErrNoDownloaders
+	}
+	return nil
+}
+
+func (f *fanout) File(name string, mode os.FileMode, size int64, r io.Reader) error {
+	err := f.each(item{op: func(p packer.PackerCloser, contents io.Reader) error {
+		return p.File(name, mode, size, io.LimitReader(contents, size))
+	}})
+	if err != nil {
+		return err
+	}
+
+	// every chunk is a new slice, members may still be reading the previous ones
+	for remaining := size; remaining > 0; {
+		chunk := make([]byte, min(remaining, fanoutChunk))
+		n, err := io.ReadFull(r, chunk)
+		if err != nil {
+			return err
+		}
+		remaining -= int64(n)
+
+		err = f.each(item{chunk: chunk})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f *fanout) Enter(name string, mode os.FileMode) error {
+	return f.each(item{op: func(p packer.PackerCloser, _ io.Reader) error {
+		return p.Enter(name, mode)
+	}})
+}
+
+func (f *fanout) Exit() error {
+	return f.each(item{op: func(p packer.PackerCloser, _ io.Reader) error {
+		return p.Exit()
+	}})
+}
+
+// Times forwards times to members able to preserve them
+func (f *fanout) Times(modified, accessed time.Time) {
+	_ = f.each(item{op: func(p packer.PackerCloser, _ io.Reader) error {
+		if ts, ok := p.(packer.Timestamper); ok {
+			ts.Times(modified, accessed)
+		}
+		return nil
+	}})
+}
+
+// Close closes the packers of every member
+func (f *fanout) Close() error {
+	err := f.each(item{op: func(p packer.PackerCloser, _ io.Reader) error {
+		return p.Close()
+	}})
+
+	for _, m := range f.members {
+		close(m.items)
+	}
+
+	return err
+}
+
+// Abort tells every member the upload failed
+func (f *fanout) Abort() error {
+	for _, m := range f.members {
+		m.fail(errUploadFailed)
+	}
+	return nil
+}
+
+// item is either an operation on the packer of a member or file contents
+type item struct {
+	// op is called with the packer of the member and the contents of files
+	op    func(p packer.PackerCloser, contents io.Reader) error
+	chunk []byte
+}
+
+// member is a downloader of a fanout sink, it implements packer.PackerTo
+type member struct {
+	fanout *fanout
+
+	// remaining downloaders after this one
+	remaining int
+
+	items   chan item
+	pending []byte
+
+	gone     chan struct{}
+	goneOnce sync.Once
+	err      error
+}
+
+// Remaining returns how many downloaders may join after this one
+func (m *member) Remaining() int {
+	return m.remaining
+}
+
+// Announce tells the uploader about the downloader of this member
+func (m *member) Announce(remote, userAgent, format string) {
+	m.fanout.sink.Announce(remote, userAgent, format)
+}
+
+// Cancel drops the member, the upload continues with the other downloaders
+func (m *member) Cancel(reason string) {
+	m.fail(errors.New(reason))
+}
+
+// fail marks the member as gone, the first error is kept
+func (m *member) fail(err error) {
+	m.goneOnce.Do(func() {
+		m.err = err
+		close(m.gone)
+	})
+}
+
+// PackTo waits for the upload to start and replays it on p
+func (m *member) PackTo(p packer.PackerCloser) error {
+	for {
+		// leave as soon as we are dropped, even with items left
+		select {
+		case <-m.gone:
+			_ = p.Close()
+			return m.err
+		default:
+		}
+
+		select {
+		case it, ok := <-m.items:
+			if !ok {
+				return nil
+			}
+
+			if it.op == nil {
+				m.fail(fmt.Errorf("file contents out of order"))
+				return m.err
+			}
+
+			err := it.op(p, m)
+			if err != nil {
+				m.fail(err)
+				return err
+			}
+
+		case <-m.gone:
+			_ = p.Close()
+			return m.err
+		}
+	}
+}
+
+// Read reads file contents sent to the member
+func (m *member) Read(b []byte) (int, error) {
+	if len(m.pending) == 0 {
+		select {
+		case it, ok := <-m.items:
+			if !ok || it.op != nil {
+				return 0, io.ErrUnexpectedEOF
+			}
+			m.pending = it.chunk
+		case <-m.gone:
+			return 0, m.err
+		}
+	}
+
+	n := copy(b, m.pending)
+	m.pending = m.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,130 @@
+package scp
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	// how often uploaders waiting for a downloader are asked if they are still there,
+	// as NAT gateways silently drop idle connections - 0 disables keepalives
+	viper.SetDefault("KEEPALIVE_INTERVAL", "30s")
+
+	// how many keepalives in a row may go unanswered before the uploader is considered gone
+	viper.SetDefault("KEEPALIVE_COUNT_MAX", 3)
+
+	// how long uploaders may wait for a downloader, 0 means forever
+	viper.SetDefault("MAX_WAIT", "24h")
+}
+
+// watch keeps the connection of a waiting sink alive, and removes the sink
+// once the uploader is gone or have waited for too long - the key of the
+// uploader may allow it to wait for less than MaxWait
+func (s *Server) watch(sink *Sink) {
+	maxWait := s.MaxWait
+	if _, maxTTL := sink.conn.limits(); maxTTL > 0 && (maxWait == 0 || maxTTL < maxWait) {
+		maxWait = maxTTL
+	}
+
+	var keepalive <-chan time.Time
+	if s.Keepalive > 0 {
+		ticker := time.NewTicker(s.Keepalive)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	var expired <-chan time.Time
+	if maxWait > 0 {
+		timer := time.NewTimer(maxWait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	missed := 0
+	for {
+		select {
+		case <-sink.conn.done:
+			if s.removeSink(sink) {
+				log.Printf("Sink %s: uploader %s is gone", sink.ID, sink.conn)
+			}
+			return
+
+		case <-keepalive:
+			if !s.waiting(sink) {
+				return
+			}
+
+			if sink.conn.alive(s.Keepalive) {
+				missed = 0
+				continue
+			}
+
+			missed++
+			if missed >= s.KeepaliveCountMax {
+				// the sink is removed once the connection is closed
+				log.Printf("Sink %s: uploader %s did not answer %d keepalives", sink.ID, sink.conn, missed)
+				_ = sink.conn.Close()
+			}
+
+		case <-expired:
+			if !s.removeSink(sink) {
+				return
+			}
+
+			log.Printf("Sink %s: nobody downloaded it within %s", sink.ID, maxWait)
+			sink.fail(fmt.Sprintf("    Nobody downloaded the transfer within %s, giving up\n", maxWait))
+			return
+		}
+	}
+}
+
+// waiting reports whether sink is still waiting for a downloader
+func (s *Server) waiting(sink *Sink) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.sinks[sink.ID] == sink
+}
+
+// removeSink removes sink if it is still waiting for a downloader, and reports whether it was
+func (s *Server) removeSink(sink *Sink) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.sinks[sink.ID] != sink {
+		return false
+	}
+
+	// fanout sinks with downloaders are about to start
+	if sink.fanout != nil && sink.fanout.joined() {
+		return false
+	}
+
+	delete(s.sinks, sink.ID)
+	return true
+}
+
+// alive sends a keepalive request and reports whether the client answered within timeout
+// - any answer will do, OpenSSH clients turn down the request
+func (c *connection) alive(timeout time.Duration) bool {
+	answered := make(chan error, 1)
+	go func() {
+		_, _, err := c.SendRequest("keepalive@openssh.com", true, nil)
+		answered <- err
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-answered:
+		return err == nil
+	case <-timer.C:
+		return false
+	case <-c.done:
+		return false
+	}
+}
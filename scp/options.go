@@ -0,0 +1,191 @@
+package scp
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fasmide/schttp/packer"
+)
+
+// Options are chosen by the uploader as a comma separated list in the ssh username,
+// e.g. scp -r someDirectory/ downloads=3,ttl=24h@scp.click: - or in the target path
+type Options struct {
+	// Spool stores the transfer on the server right away, allowing the uploader to disconnect
+	Spool bool
+
+	// Downloads is how many times the transfer may be downloaded, more than one implies Spool
+	Downloads int
+
+	// TTL is how long the transfer is kept, it implies Spool
+	TTL time.Duration
+
+	// Fanout is how many downloaders to stream the transfer to at once, it
+	// cannot be combined with Spool
+	Fanout int
+
+	// Name is the name of downloaded archives, without extension
+	Name string
+
+	// Format is the extension of the format served when the downloader does not pick one
+	Format string
+
+	// Password is required from downloaders
+	Password string
+
+	// AskPassword prompts the uploader for Password while logging in, it is
+	// set by the password option without a value
+	AskPassword bool
+	// Recipient is the public key, or its fingerprint, the transfer is encrypted to with age
+	Recipient string
+}
+
+// ParseOptions parses options from an ssh username
+//
+// Most clients send the local username if none is given - words which are not
+// options are therefore ignored, while unknown key=value options and known
+// options with bad values are errors
+func ParseOptions(user string) (Options, error) {
+	var o Options
+
+	err := o.parse(user)
+	if err != nil {
+		return o, err
+	}
+
+	return o, o.check()
+}
+
+// ParseTarget adds options from the target path of scp, which is either options
+// as in the username, or the name of the archive - e.g. scp -r dir scp.click:release.zip
+// names the archive release and picks zip
+func (o *Options) ParseTarget(target string) error {
+	target = strings.Trim(target, "/")
+	if target == "" || target == "." || target == "~" {
+		return nil
+	}
+
+	if strings.Contains(target, "=") {
+		err := o.parse(target)
+		if err != nil {
+			return err
+		}
+		return o.check()
+	}
+
+	name, format := splitFormat(path.Base(target))
+	if name != "" {
+		o.Name = name
+	}
+	if format != "" {
+		o.Format = format
+	}
+
+	return o.check()
+}
+
+// parse parses a comma separated list of options into o
+func (o *Options) parse(s string) error {
+	for _, field := range strings.Split(s, ",") {
+		key, value, hasValue := strings.Cut(strings.TrimSpace(field), "=")
+
+		switch key {
+		case "spool":
+			if !hasValue {
+				o.Spool = true
+				continue
+			}
+
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return fmt.Errorf("spool: %q is not a boolean", value)
+			}
+			o.Spool = b
+
+		case "downloads":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return fmt.Errorf("downloads: %q is not a positive number", value)
+			}
+			o.Downloads = n
+
+		case "ttl":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("ttl: %q is not a positive duration, such as 1h30m", value)
+			}
+			o.TTL = d
+
+		case "fanout":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return fmt.Errorf("fanout: %q is not a positive number", value)
+			}
+			o.Fanout = n
+
+		case "name":
+			if value == "" || value != path.Base(value) || value == "." || value == ".." {
+				return fmt.Errorf("name: %q is not a file name", value)
+			}
+			o.Name = value
+
+		case "format":
+			_, exists := packer.Lookup(value)
+			if !exists {
+				return fmt.Errorf("format: %q is not one of %s", value, packer.Extensions())
+			}
+			o.Format = value
+
+		case "password":
+			if !hasValue {
+				o.AskPassword = true
+				continue
+			}
+
+			if value == "" {
+				return fmt.Errorf("password: must not be empty")
+			}
+			o.Password = value
+
+		case "recipient":
+			if value == "" {
+				return fmt.Errorf("recipient: must be a public key or its SHA256 fingerprint")
+			}
+			o.Recipient = value
+
+		default:
+			// a mistyped option must not result in a link without it
+			if hasValue {
+				return fmt.Errorf("%s: unknown option, use spool, downloads, ttl, fanout, name, format, password or recipient", key)
+			}
+		}
+	}
+
+	return nil
+}
+
+// check reports options which cannot be combined
+func (o *Options) check() error {
+	if o.Fanout > 1 && (o.Spool || o.Downloads > 1 || o.TTL > 0) {
+		return fmt.Errorf("fanout: cannot be combined with spool, downloads or ttl")
+	}
+	return nil
+}
+
+// splitFormat splits the extension of a known format from name
+func splitFormat(name string) (string, string) {
+	format := ""
+	for _, f := range packer.Formats() {
+		// the longest match wins, e.g. tar.gz over gz
+		if strings.HasSuffix(name, "."+f.Extension) && len(f.Extension) > len(format) {
+			format = f.Extension
+		}
+	}
+
+	if format == "" {
+		return name, ""
+	}
+	return strings.TrimSuffix(name, "."+format), format
+}
@@ -0,0 +1,74 @@
+package scp
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
+)
+
+// passwordExtension holds the download password given while logging in
+const passwordExtension = "password"
+
+// noClientAuth lets everyone in without authentication, except uploaders asking
+// to be prompted for a download password - their clients moves on to keyboard-interactive
+func noClientAuth(meta ssh.ConnMetadata) (*ssh.Permissions, error) {
+	options, err := ParseOptions(meta.User())
+	if err == nil && options.AskPassword {
+		return nil, errors.New("download password wanted")
+	}
+	return nil, nil
+}
+
+// askPassword prompts the uploader for a download password
+func askPassword(meta ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+	answers, err := client(
+		meta.User(),
+		"Downloaders will need this password",
+		[]string{"Download password: ", "Again: "},
+		[]bool{false, false},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(answers) != 2 || answers[0] == "" {
+		return nil, errors.New("no password given")
+	}
+
+	if answers[0] != answers[1] {
+		return nil, errors.New("passwords do not match")
+	}
+
+	return &ssh.Permissions{Extensions: map[string]string{passwordExtension: answers[0]}}, nil
+}
+
+// password returns the download password of the uploader, if any
+func (c *connection) password(options Options) (string, error) {
+	if !options.AskPassword {
+		return options.Password, nil
+	}
+
+	if c.Permissions == nil || c.Permissions.Extensions[passwordExtension] == "" {
+		return "", errors.New("password: no password was given")
+	}
+	return c.Permissions.Extensions[passwordExtension], nil
+}
+
+// hashPassword hashes password with bcrypt, an empty password is no password
+func hashPassword(password string) ([]byte, error) {
+	if password == "" {
+		return nil, nil
+	}
+	return bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+}
+
+// Protected reports whether downloaders must know a password
+func (s *Sink) Protected() bool {
+	return s.password != nil
+}
+
+// Authenticate reports whether password is the download password
+func (s *Sink) Authenticate(password string) bool {
+	return s.password == nil || bcrypt.CompareHashAndPassword(s.password, []byte(password)) == nil
+}
@@ -0,0 +1,149 @@
+package scp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/fasmide/schttp/packer"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	// how often uploaders are told about the progress of their transfer, 0 disables it
+	viper.SetDefault("PROGRESS_INTERVAL", "10s")
+}
+
+// progress counts files and bytes as they pass from the uploader to the packer,
+// and the bytes of the archive delivered to the downloader
+type progress struct {
+	files     atomic.Int64
+	bytes     atomic.Int64
+	delivered atomic.Int64
+	started   time.Time
+
+	// metered is set if delivered bytes are counted, which they are not for
+	// transfers packed by the server itself - e.g. spooled ones
+	metered bool
+}
+
+// newProgress returns a progress started right now
+func newProgress() *progress {
+	return &progress{started: time.Now()}
+}
+
+// report writes the progress to w every interval, until done is closed
+func (p *progress) report(w io.Writer, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last, lastDelivered int64
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			bytes := p.bytes.Load()
+			rate := float64(bytes-last) / interval.Seconds()
+			last = bytes
+
+			if !p.metered {
+				fmt.Fprintf(w, "    %d files, %s at %s/s\n", p.files.Load(), formatBytes(float64(bytes)), formatBytes(rate))
+				continue
+			}
+
+			delivered := p.delivered.Load()
+			deliveredRate := float64(delivered-lastDelivered) / interval.Seconds()
+			lastDelivered = delivered
+
+			fmt.Fprintf(w, "    %d files, %s received at %s/s, %s delivered at %s/s\n",
+				p.files.Load(),
+				formatBytes(float64(bytes)),
+				formatBytes(rate),
+				formatBytes(float64(delivered)),
+				formatBytes(deliveredRate),
+			)
+		}
+	}
+}
+
+// summary describes the whole transfer
+func (p *progress) summary() string {
+	elapsed := time.Since(p.started)
+	bytes := p.bytes.Load()
+
+	summary := fmt.Sprintf("    Transferred %d files, %s in %s at %s/s",
+		p.files.Load(),
+		formatBytes(float64(bytes)),
+		elapsed.Round(time.Millisecond),
+		formatBytes(float64(bytes)/elapsed.Seconds()),
+	)
+	if p.metered {
+		summary += fmt.Sprintf(", %s delivered to the downloader", formatBytes(float64(p.delivered.Load())))
+	}
+
+	return summary + "\n"
+}
+
+// progressPacker counts files and the bytes of their contents read by the packer
+type progressPacker struct {
+	packer.Packer
+	progress *progress
+}
+
+func (p *progressPacker) File(name string, mode os.FileMode, size int64, r io.Reader) error {
+	err := p.Packer.File(name, mode, size, &progressReader{Reader: r, progress: p.progress})
+	if err == nil {
+		p.progress.files.Add(1)
+	}
+	return err
+}
+
+// Times passes file times on to the packer, if it is able to preserve them
+func (p *progressPacker) Times(modified, accessed time.Time) {
+	if ts, ok := p.Packer.(packer.Timestamper); ok {
+		ts.Times(modified, accessed)
+	}
+}
+
+// progressReader adds the number of bytes read to the progress
+type progressReader struct {
+	io.Reader
+	progress *progress
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.Reader.Read(b)
+	p.progress.bytes.Add(int64(n))
+	return n, err
+}
+
+// progressWriter adds the number of bytes written to the delivered bytes of the progress
+type progressWriter struct {
+	io.Writer
+	progress *progress
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.Writer.Write(b)
+	p.progress.delivered.Add(int64(n))
+	return n, err
+}
+
+// formatBytes formats a number of bytes with a binary prefix, e.g. 1.5 MiB
+func formatBytes(n float64) string {
+	const prefixes = "KMGTPE"
+
+	if n < 1024 {
+		return fmt.Sprintf("%.0f B", n)
+	}
+
+	i := -1
+	for n >= 1024 && i < len(prefixes)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", n, prefixes[i])
+}
@@ -0,0 +1,37 @@
+package scp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/fasmide/schttp/packer"
+)
+
+// ErrQuota is returned when a transfer exceeds the quota of the key of the uploader
+var ErrQuota = errors.New("transfer exceeds the quota of your key")
+
+// quotaPacker turns down files once the transfer exceeds its quota
+type quotaPacker struct {
+	packer.Packer
+
+	// remaining bytes of the quota
+	remaining int64
+}
+
+func (q *quotaPacker) File(name string, mode os.FileMode, size int64, r io.Reader) error {
+	if size > q.remaining {
+		return ErrQuota
+	}
+	q.remaining -= size
+
+	return q.Packer.File(name, mode, size, r)
+}
+
+// Times passes file times on to the packer, if it is able to preserve them
+func (q *quotaPacker) Times(modified, accessed time.Time) {
+	if ts, ok := q.Packer.(packer.Timestamper); ok {
+		ts.Times(modified, accessed)
+	}
+}
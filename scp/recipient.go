@@ -0,0 +1,95 @@
+package scp
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fasmide/schttp/packer"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+func init() {
+	// directory of public keys, in authorized_keys format, which uploaders may
+	// name as recipient by their fingerprint
+	viper.SetDefault("RECIPIENT_DIRECTORY", "recipients")
+}
+
+// resolveRecipient returns the public key of recipient, which is either a
+// public key or the SHA256 fingerprint of a key in directory
+//
+// ssh does not allow spaces in usernames, public keys may therefore be given
+// without their type, e.g. recipient=AAAAC3NzaC1lZDI1NTE5AAAA...
+func resolveRecipient(recipient, directory string) (string, error) {
+	if recipient == "" {
+		return "", nil
+	}
+
+	if blob, err := base64.StdEncoding.DecodeString(recipient); err == nil {
+		key, err := ssh.ParsePublicKey(blob)
+		if err != nil {
+			return "", fmt.Errorf("recipient: %w", err)
+		}
+		recipient = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	}
+
+	if !strings.HasPrefix(recipient, "SHA256:") {
+		_, err := packer.ParseRecipient(recipient)
+		if err != nil {
+			return "", fmt.Errorf("recipient: %w", err)
+		}
+		return recipient, nil
+	}
+
+	files, err := filepath.Glob(filepath.Join(directory, "*"))
+	if err != nil {
+		return "", err
+	}
+
+	for _, file := range files {
+		key, err := findKey(file, recipient)
+		if err != nil {
+			return "", fmt.Errorf("recipient: %w", err)
+		}
+		if key != "" {
+			return key, nil
+		}
+	}
+
+	return "", fmt.Errorf("recipient: no known key has the fingerprint %s", recipient)
+}
+
+// findKey returns the public key in file with the given fingerprint, or "" if there is none
+func findKey(file, fingerprint string) (string, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		key, _, _, _, err := ssh.ParseAuthorizedKey(scanner.Bytes())
+		if err != nil {
+			// comments, empty lines and whatever else is not a key
+			continue
+		}
+
+		if ssh.FingerprintSHA256(key) != fingerprint {
+			continue
+		}
+
+		line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+		_, err = packer.ParseRecipient(line)
+		if err != nil {
+			return "", fmt.Errorf("%s cannot be used: %w", fingerprint, err)
+		}
+		return line, nil
+	}
+
+	return "", scanner.Err()
+}
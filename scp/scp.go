@@ -2,13 +2,17 @@ package scp
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fasmide/schttp/packer"
+	"github.com/fasmide/schttp/spool"
 )
 
 type ScpStream struct {
@@ -24,77 +28,243 @@ const (
 	Directory
 	TimeCreatedModified
 	Exit
+
+	// Warning and Failure are sent by clients unable to send a file, Failure ends the transfer
+	Warning
+	Failure
+)
+
+var (
+	// ErrEmptyRecord is returned for records without a type
+	ErrEmptyRecord = errors.New("empty record")
+
+	// ErrUnterminated is returned for records not ending with a newline
+	ErrUnterminated = errors.New("record does not end with a newline")
+
+	// ErrUnsupportedType is returned for records of an unknown type
+	ErrUnsupportedType = errors.New("unsupported record type")
+
+	// ErrBadMode is returned when the mode is not four octal digits
+	ErrBadMode = errors.New("mode is not four octal digits")
+
+	// ErrBadLength is returned when the length is not a decimal number
+	ErrBadLength = errors.New("length is not a decimal number")
+
+	// ErrBadTimes is returned when the times of a T record are malformed
+	ErrBadTimes = errors.New("times are malformed")
+
+	// ErrBadName is returned for names which are empty, "." or "..", or contain a slash
+	ErrBadName = errors.New("name is not a file name")
 )
 
+// ParseError describes a malformed scp record, Err is one of the errors above
+type ParseError struct {
+	Record []byte
+	Err    error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("scp record %q: %s", e.Record, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
 type Command struct {
 	Name   string
 	Mode   os.FileMode
 	Length int64
 	Type   Type
+
+	// Modified and Accessed are only set by T commands
+	Modified time.Time
+	Accessed time.Time
+
+	// Message is only set by warnings and failures
+	Message string
 }
 
+// Parse parses a single scp record, including its trailing newline. Records are one of
+//
+//	C0644 352 some file name   a file of 352 bytes follows
+//	D0755 0 some-directory     the following files are in a directory
+//	E                          the end of a directory
+//	T1634991954 0 1634991954 0 modified and access times of the following file or directory
+//	\x01some warning           the client was unable to send a file
+//	\x02some error             the client gives up
+//
+// Names are everything between the length and the newline, spaces and tabs included
 func (c *Command) Parse(raw []byte) error {
-	c.Type = Unsupported
-	// Determinane what type of Command we are dealing with
-	if raw[0] == 'C' {
-		c.Type = Create
+	*c = Command{Type: Unsupported}
+
+	err := c.parse(raw)
+	if err != nil {
+		return &ParseError{Record: raw, Err: err}
 	}
-	if raw[0] == 'D' {
-		c.Type = Directory
+	return nil
+}
+
+// parse does the actual parsing of Parse, returning one of the sentinel errors
+func (c *Command) parse(raw []byte) error {
+	if len(raw) == 0 {
+		return ErrEmptyRecord
 	}
-	if raw[0] == 'E' {
+	if raw[len(raw)-1] != '\n' {
+		return ErrUnterminated
+	}
+	if len(raw) == 1 {
+		return ErrEmptyRecord
+	}
+
+	// the record without type and newline
+	record := string(raw[1 : len(raw)-1])
+
+	switch raw[0] {
+	case 'C', 'D':
+		return c.parseEntry(raw[0], record)
+
+	case 'E':
+		if record != "" {
+			return ErrUnsupportedType
+		}
 		c.Type = Exit
-		c.Name = ""
-		c.Mode = 0
-		c.Length = 0
 		return nil
-	}
-	if raw[0] == 'T' {
-		// we dont fully support T
-		// but we also dont need it, its about access and modified time
-		c.Type = TimeCreatedModified
-		c.Name = ""
-		c.Mode = 0
-		c.Length = 0
+
+	case 'T':
+		// T commands holds modified and access times of the following file or directory
+		//   T1634991954 0 1634991954 0<0x0A || LineFeed>
+		return c.parseTimes(record)
+
+	case 0x01, 0x02:
+		c.Type = Warning
+		if raw[0] == 0x02 {
+			c.Type = Failure
+		}
+		c.Message = record
 		return nil
 	}
 
-	if c.Type == Unsupported {
-		return fmt.Errorf("unsupported scp command: \"%s\" %x", string(raw), raw)
+	return ErrUnsupportedType
+}
+
+// parseEntry parses mode, length and name of a C or D record, such as "0664 352 test-node-ssl-js"
+func (c *Command) parseEntry(t byte, record string) error {
+	mode, rest, ok := strings.Cut(record, " ")
+	if !ok || len(mode) != 4 {
+		return ErrBadMode
+	}
+	for _, d := range mode {
+		if d < '0' || d > '7' {
+			return ErrBadMode
+		}
 	}
+	m, _ := strconv.ParseUint(mode, 8, 32)
 
-	i64, err := strconv.ParseUint(string(raw[1:4]), 8, 32)
+	length, name, ok := strings.Cut(rest, " ")
+	if !ok {
+		return ErrBadLength
+	}
+	l, err := parseDigits(length)
 	if err != nil {
-		return fmt.Errorf("unable to parse file mode from %s: %s", string(raw[1:4]), err)
+		return ErrBadLength
 	}
-	c.Mode = os.FileMode(uint32(i64))
-
-	// split by space into fields for Name and Length
-	fields := strings.Fields(string(raw))
 
-	// Name is the third field and beyond
-	// TODO: dont use Fields - use some kind of ReadUntil or something
-	c.Name = strings.Trim(strings.Join(fields[2:], " "), "\n\r\x0A")
+	// names are used as is, they may not leave the directory they are in
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return ErrBadName
+	}
 
-	l, err := strconv.ParseInt(fields[1], 10, 64)
-	if err != nil {
-		return fmt.Errorf("unable to parse file length: %s", err)
+	c.Type = Create
+	if t == 'D' {
+		c.Type = Directory
 	}
+	c.Mode = packer.FileMode(uint32(m))
 	c.Length = l
+	c.Name = name
 
 	return nil
 }
 
+// parseTimes parses seconds and microseconds of modified and access times
+func (c *Command) parseTimes(record string) error {
+	fields := strings.Split(record, " ")
+	if len(fields) != 4 {
+		return ErrBadTimes
+	}
+
+	var values [4]int64
+	for i, f := range fields {
+		v, err := parseDigits(f)
+		if err != nil {
+			return ErrBadTimes
+		}
+		values[i] = v
+	}
+
+	// microseconds are below a second
+	if values[1] > 999999 || values[3] > 999999 {
+		return ErrBadTimes
+	}
+
+	c.Type = TimeCreatedModified
+	c.Modified = time.Unix(values[0], values[1]*int64(time.Microsecond))
+	c.Accessed = time.Unix(values[2], values[3]*int64(time.Microsecond))
+
+	return nil
+}
+
+// parseDigits parses a non negative decimal number, without any sign or spaces
+func parseDigits(s string) (int64, error) {
+	if s == "" {
+		return 0, strconv.ErrSyntax
+	}
+	for _, d := range s {
+		if d < '0' || d > '9' {
+			return 0, strconv.ErrSyntax
+		}
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// Replies to scp commands, besides the NUL of success, are followed by a message
+const (
+	// replyWarning tells the client something went wrong, but the transfer goes on
+	replyWarning = 0x01
+
+	// replyError tells the client the transfer have failed
+	replyError = 0x02
+)
+
+// maxDrain is the most file contents read and thrown away once the packer have
+// failed, as clients only read our reply once they have sent the whole file
+const maxDrain = 64 << 20
+
 // Pack reads files from an scp client and packs them with a given Packer
+//
+// Files refused by the packer before reading their contents may be skipped with a
+// warning, while other failures of the packer are replied to with an error
 func (s *ScpStream) Pack(p packer.Packer) error {
+	// times from the latest T command
+	var times *Command
+
+	// files packed so far
+	files := 0
+
+	// the client waits for a reply to its latest command, unless it was refused
+	replied := false
+
 	// until something returns...
 	for {
 
 		// ask remote client to advance
-		_, err := s.Write([]byte{0x00})
-		if err != nil {
-			return fmt.Errorf("unable to advance remote scp client: %s", err)
+		if !replied {
+			_, err := s.Write([]byte{0x00})
+			if err != nil {
+				return fmt.Errorf("unable to advance remote scp client: %s", err)
+			}
 		}
+		replied = false
 		// an scp command looks something like this
 		//   C0664 352 test-node-ssl-js<0x0A || LineFeed>
 		var c Command
@@ -111,22 +281,61 @@ func (s *ScpStream) Pack(p packer.Packer) error {
 
 		err = c.Parse(line)
 		if err != nil {
-			return fmt.Errorf("unable to parse scp command: %s", err)
+			_ = s.reply(replyError, err.Error())
+			return fmt.Errorf("unable to parse scp command: %w", err)
 		}
 
+		// clients unable to send a file tell so, without waiting for a reply
 		switch c.Type {
-		case Create:
-			// ask remote client to send file
-			_, err := s.Write([]byte{0x00})
-			if err != nil {
-				return fmt.Errorf("unable to advance remote scp client: %s", err)
+		case Warning:
+			log.Printf("Scp: client warns: %q", c.Message)
+			replied = true
+			continue
+		case Failure:
+			return fmt.Errorf("remote scp client failed: %q", c.Message)
+		}
+
+		// times from a T command applies to the following file or directory
+		if c.Type == Create || c.Type == Directory {
+			if t, ok := p.(packer.Timestamper); ok && times != nil {
+				t.Times(times.Modified, times.Accessed)
 			}
+			times = nil
+		}
+
+		switch c.Type {
+		case TimeCreatedModified:
+			times = &c
+		case Create:
+			// the client is asked to send the file once the packer reads it,
+			// leaving room to refuse the file in reply to its command
+			contents := &contentReader{stream: s, limited: &io.LimitedReader{R: s, N: c.Length}}
 
 			// Pack the file
-			err = p.File(c.Name, c.Mode, c.Length, io.LimitReader(s, c.Length))
+			err = p.File(c.Name, c.Mode, c.Length, contents)
+
+			if err != nil && !contents.asked && warning(err) {
+				// the client goes on with the next file
+				err = s.reply(replyWarning, fmt.Sprintf("%s: %s", c.Name, err))
+				if err != nil {
+					return fmt.Errorf("unable to warn remote scp client: %s", err)
+				}
+				replied = true
+				continue
+			}
 
 			if err != nil {
-				return fmt.Errorf("unable to pack: %s", err)
+				// the client must have sent the whole file before reading our reply
+				if !contents.asked || s.drain(contents.limited) {
+					_ = s.reply(replyError, reason(err, files))
+				}
+				return fmt.Errorf("unable to pack: %w", err)
+			}
+
+			// ask remote client to send file, if the packer did not read it
+			err = contents.ask()
+			if err != nil {
+				return err
 			}
 
 			// the client will send a NUL after sending a file
@@ -137,12 +346,199 @@ func (s *ScpStream) Pack(p packer.Packer) error {
 			if b != 0x00 {
 				return fmt.Errorf("advance NUL byte was not NUL: it was %x", b)
 			}
+			files++
 
 		case Directory:
-			p.Enter(c.Name, c.Mode)
+			err = p.Enter(c.Name, c.Mode)
+			if err != nil {
+				_ = s.reply(replyError, reason(err, files))
+				return fmt.Errorf("unable to pack: %w", err)
+			}
 		case Exit:
-			p.Exit()
+			err = p.Exit()
+			if err != nil {
+				_ = s.reply(replyError, reason(err, files))
+				return fmt.Errorf("unable to pack: %w", err)
+			}
+		}
+	}
+
+}
+
+// Fail tells the remote scp client the transfer have failed, while it waits
+// for a reply
+func (s *ScpStream) Fail(msg string) error {
+	return s.reply(replyError, msg)
+}
+
+// reply sends a warning or error to the remote scp client, which prints the message
+func (s *ScpStream) reply(code byte, msg string) error {
+	// messages are a single line
+	msg = strings.Join(strings.Fields(msg), " ")
+
+	_, err := fmt.Fprintf(s, "%c%s\n", code, msg)
+	return err
+}
+
+// drain reads and throws away the rest of a file and its trailing NUL, it
+// reports whether the client is now waiting for a reply
+func (s *ScpStream) drain(contents *io.LimitedReader) bool {
+	if contents.N > maxDrain {
+		return false
+	}
+
+	_, err := io.Copy(io.Discard, contents)
+	if err != nil {
+		return false
+	}
+
+	b, err := s.ReadByte()
+	return err == nil && b == 0x00
+}
+
+// contentReader asks the remote scp client to send the contents of a file
+// once they are read
+type contentReader struct {
+	stream  *ScpStream
+	limited *io.LimitedReader
+	asked   bool
+}
+
+// ask asks the remote client to send the file, unless it have been asked already
+func (c *contentReader) ask() error {
+	if c.asked {
+		return nil
+	}
+	c.asked = true
+
+	_, err := c.stream.Write([]byte{0x00})
+	if err != nil {
+		return fmt.Errorf("unable to advance remote scp client: %s", err)
+	}
+	return nil
+}
+
+func (c *contentReader) Read(b []byte) (int, error) {
+	err := c.ask()
+	if err != nil {
+		return 0, err
+	}
+	return c.limited.Read(b)
+}
+
+// warning reports whether err only concerns a single file, which may be skipped
+func warning(err error) bool {
+	return errors.Is(err, ErrQuota)
+}
+
+// reason describes why packing failed to the uploader, after the given number of files
+func reason(err error, files int) string {
+	count := fmt.Sprintf("%d files", files)
+	if files == 1 {
+		count = "1 file"
+	}
+
+	known := []error{spool.ErrFull, packer.ErrDirectory, packer.ErrMultipleFiles, ErrNoDownloaders}
+	for _, k := range known {
+		if errors.Is(err, k) {
+			return fmt.Sprintf("transfer failed after %s: %s", count, k)
 		}
 	}
 
+	return fmt.Sprintf("downloader disconnected after %s", count)
+}
+
+// Send sends a single file to an scp client, acting as the scp source
+func (s *ScpStream) Send(c *Command, r io.Reader) error {
+	// the remote client starts by asking us to advance
+	err := s.ack()
+	if err != nil {
+		return fmt.Errorf("remote scp client did not start: %w", err)
+	}
+
+	return s.send(c, r)
+}
+
+// SendDirectory sends a single file wrapped in a directory to an scp client
+func (s *ScpStream) SendDirectory(d *Command, c *Command, r io.Reader) error {
+	err := s.ack()
+	if err != nil {
+		return fmt.Errorf("remote scp client did not start: %w", err)
+	}
+
+	//   D0755 0 some-directory<0x0A || LineFeed>
+	err = s.command("D%04o 0 %s\n", packer.UnixMode(d.Mode), d.Name)
+	if err != nil {
+		return err
+	}
+
+	err = s.send(c, r)
+	if err != nil {
+		return err
+	}
+
+	return s.command("E\n")
+}
+
+// send sends a file once the remote client is ready for it
+func (s *ScpStream) send(c *Command, r io.Reader) error {
+	// the mode is sent as four octal digits
+	//   C0644 352 test-node-ssl-js<0x0A || LineFeed>
+	err := s.command("C%04o %d %s\n", packer.UnixMode(c.Mode), c.Length, c.Name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(s, r, c.Length)
+	if err != nil {
+		return fmt.Errorf("unable to send file contents: %w", err)
+	}
+
+	// a file is terminated by a NUL
+	_, err = s.Write([]byte{0x00})
+	if err != nil {
+		return fmt.Errorf("unable to terminate file: %w", err)
+	}
+
+	err = s.ack()
+	if err != nil {
+		return fmt.Errorf("remote scp client did not accept file: %w", err)
+	}
+
+	return nil
+}
+
+// command sends an scp command and waits for the remote client to accept it
+func (s *ScpStream) command(format string, a ...interface{}) error {
+	_, err := fmt.Fprintf(s, format, a...)
+	if err != nil {
+		return fmt.Errorf("unable to send scp command: %w", err)
+	}
+
+	err = s.ack()
+	if err != nil {
+		return fmt.Errorf("remote scp client refused %q: %w", strings.TrimSpace(fmt.Sprintf(format, a...)), err)
+	}
+
+	return nil
+}
+
+// ack reads a response from the remote scp client, a NUL means everything
+// is fine while 0x01 and 0x02 is followed by a (warning or error) message
+func (s *ScpStream) ack() error {
+	b, err := s.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	if b == 0x00 {
+		return nil
+	}
+
+	msg, err := s.ReadString(byte(0x0A))
+	if err != nil {
+		return fmt.Errorf("unable to read response %x: %w", b, err)
+	}
+
+	return fmt.Errorf("remote scp client responded %x: %s", b, strings.TrimSpace(msg))
 }
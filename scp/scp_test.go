@@ -0,0 +1,154 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/fasmide/schttp/packer"
+)
+
+// format formats a parsed command as the record it was parsed from
+func format(c *Command) string {
+	switch c.Type {
+	case Create:
+		return fmt.Sprintf("C%04o %d %s\n", packer.UnixMode(c.Mode), c.Length, c.Name)
+	case Directory:
+		return fmt.Sprintf("D%04o %d %s\n", packer.UnixMode(c.Mode), c.Length, c.Name)
+	case Exit:
+		return "E\n"
+	case TimeCreatedModified:
+		return fmt.Sprintf("T%d %d %d %d\n",
+			c.Modified.Unix(), c.Modified.Nanosecond()/1000,
+			c.Accessed.Unix(), c.Accessed.Nanosecond()/1000,
+		)
+	case Warning:
+		return "\x01" + c.Message + "\n"
+	case Failure:
+		return "\x02" + c.Message + "\n"
+	}
+	return ""
+}
+
+func TestCommandParse(t *testing.T) {
+	tests := []struct {
+		raw  string
+		err  error
+		name string
+	}{
+		{raw: "C0644 352 test-node-ssl-js\n", name: "test-node-ssl-js"},
+		{raw: "C0644 0 two  spaces\tand tab \n", name: "two  spaces\tand tab "},
+		{raw: "D0755 0 some-directory\n", name: "some-directory"},
+		{raw: "C0644 352 \xff\xfe\n", name: "\xff\xfe"},
+		{raw: "E\n"},
+		{raw: "T1634991954 0 1634991954 999999\n"},
+		{raw: "\x01scp: secret: Permission denied\n"},
+		{raw: "", err: ErrEmptyRecord},
+		{raw: "\n", err: ErrEmptyRecord},
+		{raw: "C0644 352 name", err: ErrUnterminated},
+		{raw: "X\n", err: ErrUnsupportedType},
+		{raw: "E0\n", err: ErrUnsupportedType},
+		{raw: "C\n", err: ErrBadMode},
+		{raw: "C644 352 name\n", err: ErrBadMode},
+		{raw: "C0648 352 name\n", err: ErrBadMode},
+		{raw: "C0644 -1 name\n", err: ErrBadLength},
+		{raw: "C0644 +1 name\n", err: ErrBadLength},
+		{raw: "C0644  352 name\n", err: ErrBadLength},
+		{raw: "C0644 99999999999999999999 name\n", err: ErrBadLength},
+		{raw: "C0644 352\n", err: ErrBadLength},
+		{raw: "C0644 352 \n", err: ErrBadName},
+		{raw: "C0644 352 ..\n", err: ErrBadName},
+		{raw: "C0644 352 ../etc/passwd\n", err: ErrBadName},
+		{raw: "T1634991954 0 1634991954\n", err: ErrBadTimes},
+		{raw: "T1634991954 1000000 1634991954 0\n", err: ErrBadTimes},
+		{raw: "T1634991954  0 1634991954 0\n", err: ErrBadTimes},
+	}
+
+	for _, test := range tests {
+		var c Command
+		err := c.Parse([]byte(test.raw))
+		if !errors.Is(err, test.err) {
+			t.Fatalf("%q: expected %v, got %v", test.raw, test.err, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		if c.Name != test.name {
+			t.Fatalf("%q: wrong name %q", test.raw, c.Name)
+		}
+		if format(&c) != test.raw {
+			t.Fatalf("%q: formatted as %q", test.raw, format(&c))
+		}
+	}
+}
+
+func FuzzCommandParse(f *testing.F) {
+	f.Add([]byte("C0644 352 test-node-ssl-js\n"))
+	f.Add([]byte("D0755 0 some directory\n"))
+	f.Add([]byte("E\n"))
+	f.Add([]byte("T1634991954 0 1634991954 0\n"))
+	f.Add([]byte("\x02scp: failed\n"))
+
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		var c Command
+		err := c.Parse(raw)
+		if err != nil {
+			var parseError *ParseError
+			if !errors.As(err, &parseError) {
+				t.Fatalf("%q: error is not a *ParseError: %v", raw, err)
+			}
+			return
+		}
+
+		// whatever parses is parsed the same once formatted
+		var again Command
+		err = again.Parse([]byte(format(&c)))
+		if err != nil || !reflect.DeepEqual(c, again) {
+			t.Fatalf("%q: parsed again as %+v: %v", raw, again, err)
+		}
+	})
+}
+
+func FuzzPack(f *testing.F) {
+	f.Add([]byte("D0755 0 dir\nT1634991954 0 1634991954 0\nC0644 5 file\nhello\x00E\n"))
+	f.Add([]byte("C0644 0 empty\n\x00\x01scp: secret: Permission denied\nC0644 1 a\na\x00"))
+	f.Add([]byte("C0644 10 short\nhel"))
+	f.Add([]byte("\x02scp: failed\n"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var replies bytes.Buffer
+		stream := &ScpStream{Writer: &replies, Reader: bufio.NewReader(bytes.NewReader(data))}
+
+		z := packer.NewZip(io.Discard)
+		err := stream.Pack(z)
+		if err == nil {
+			t.Fatalf("%q: pack ended without error", data)
+		}
+		_ = z.Close()
+
+		// replies are NULs, or a warning or error terminated by a single newline
+		r := bufio.NewReader(&replies)
+		for {
+			b, err := r.ReadByte()
+			if err == io.EOF {
+				return
+			}
+
+			switch b {
+			case 0x00:
+			case replyWarning, replyError:
+				msg, err := r.ReadString('\n')
+				if err != nil {
+					t.Fatalf("%q: unterminated reply %q", data, msg)
+				}
+			default:
+				t.Fatalf("%q: unexpected reply %x", data, b)
+			}
+		}
+	})
+}
@@ -1,15 +1,19 @@
 package scp
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/fasmide/hostkeys"
 	"github.com/fasmide/schttp/packer"
+	"github.com/fasmide/schttp/spool"
+	"github.com/spf13/viper"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -48,9 +52,26 @@ type Server struct {
 	sinks   map[string]*Sink
 	sources map[string]*Source
 
+	// spool stores transfers when the uploader does not want to wait for a downloader
+	spool *spool.Spool
+
 	listener  net.Listener
 	sshConfig *ssh.ServerConfig
 
+	// Keepalive is how often waiting uploaders are asked if they are still there,
+	// they are considered gone after KeepaliveCountMax unanswered requests
+	Keepalive         time.Duration
+	KeepaliveCountMax int
+
+	// MaxWait is how long uploaders may wait for a downloader
+	MaxWait time.Duration
+
+	// SFTPMaxSize is how many bytes sftp uploads may have spooled to disk at once
+	SFTPMaxSize int64
+
+	// RecipientDirectory holds public keys which recipients may be given by fingerprint
+	RecipientDirectory string
+
 	// this bool indicates if we have been shutdown
 	// - when shutdown the server should not accept any
 	//   more sinks or sources
@@ -66,11 +87,14 @@ type Server struct {
 func NewServer() *Server {
 	// ssh.ServerConfig
 	// - Anyone can login with any combination of user and password
-	// - Any public key is accepted
+	// - Any public key is accepted, unless AUTHORIZED_KEYS or USER_CA is set
+	// - Uploaders logging in as "password" are prompted for a download password
 	config := &ssh.ServerConfig{
-		NoClientAuth:   true,
-		ServerVersion:  "SSH-2.0-schttp",
-		BannerCallback: SSHBanner,
+		NoClientAuth:                true,
+		NoClientAuthCallback:        noClientAuth,
+		KeyboardInteractiveCallback: askPassword,
+		ServerVersion:               "SSH-2.0-schttp",
+		BannerCallback:              SSHBanner,
 		Config: ssh.Config{
 			// Add in the default preferred ciphers minus chacha20 Poly
 			// as we would like AES-NI acceleration
@@ -81,18 +105,44 @@ func NewServer() *Server {
 		},
 	}
 
+	var principals []string
+	if p := viper.GetString("USER_CA_PRINCIPALS"); p != "" {
+		principals = strings.Split(p, ",")
+	}
+
+	err := requireKeys(config, viper.GetString("AUTHORIZED_KEYS"), viper.GetString("USER_CA"), principals)
+	if err != nil {
+		log.Fatalf("unable to set up authentication: %s", err)
+	}
+
 	// hostkeys defaults to current work directory
 	m := &hostkeys.Manager{}
 
-	err := m.Manage(config)
+	err = m.Manage(config)
 	if err != nil {
 		log.Fatalf("unable to manage keys: %s", err)
 	}
 
+	err = hostCertificates(m, config)
+	if err != nil {
+		log.Fatalf("unable to read host certificates: %s", err)
+	}
+
+	sp, err := newSpool()
+	if err != nil {
+		log.Fatalf("unable to set up spool: %s", err)
+	}
+
 	return &Server{
-		sinks:     make(map[string]*Sink),
-		sources:   make(map[string]*Source),
-		sshConfig: config,
+		sinks:              make(map[string]*Sink),
+		sources:            make(map[string]*Source),
+		spool:              sp,
+		sshConfig:          config,
+		Keepalive:          viper.GetDuration("KEEPALIVE_INTERVAL"),
+		KeepaliveCountMax:  viper.GetInt("KEEPALIVE_COUNT_MAX"),
+		MaxWait:            viper.GetDuration("MAX_WAIT"),
+		SFTPMaxSize:        viper.GetInt64("SFTP_MAX_SIZE"),
+		RecipientDirectory: viper.GetString("RECIPIENT_DIRECTORY"),
 	}
 }
 
@@ -100,18 +150,61 @@ func SSHBanner(meta ssh.ConnMetadata) string {
 	return fmt.Sprintf(Banner, meta.RemoteAddr().String())
 }
 
+// Sink removes and returns a waiting or spooled sink
 func (s *Server) Sink(id string) (packer.PackerTo, error) {
 	s.Lock()
-	defer s.Unlock()
-
-	if sink, exists := s.sinks[id]; exists {
+	sink, exists := s.sinks[id]
+	if exists && sink.fanout == nil {
 		delete(s.sinks, id)
+	}
+	s.Unlock()
+
+	// fanout sinks are removed once the upload starts
+	if exists && sink.fanout != nil {
+		return sink.fanout.join()
+	}
+
+	if exists {
 		return sink, nil
 	}
-	return nil, fmt.Errorf("%s does not exist", id)
+
+	return s.spool.Take(id)
+}
+
+// Peek returns a sink without removing it
+func (s *Server) Peek(id string) (packer.PackerTo, error) {
+	s.Lock()
+	sink, exists := s.sinks[id]
+	s.Unlock()
+
+	if exists {
+		return sink, nil
+	}
+
+	return s.spool.Stat(id)
+}
+
+// Source registers a new source for a file with the given name and length,
+// the returned io.ReaderFrom blocks until an scp client fetches the source
+func (s *Server) Source(name string, length int64) (string, io.ReaderFrom, error) {
+	source, err := NewSource(name, length)
+	if err != nil {
+		return "", nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.shutdown {
+		return "", nil, fmt.Errorf("server is shutting down")
+	}
+
+	s.sources[source.ID] = source
+	return source.ID, &removingSource{Source: source, server: s}, nil
 }
 
-func (s *Server) Source(id string) (io.ReaderFrom, error) {
+// takeSource removes and returns a waiting source
+func (s *Server) takeSource(id string) (*Source, error) {
 	s.Lock()
 	defer s.Unlock()
 
@@ -122,6 +215,47 @@ func (s *Server) Source(id string) (io.ReaderFrom, error) {
 	return nil, fmt.Errorf("%s does not exist", id)
 }
 
+// peekSource returns a waiting source without removing it
+func (s *Server) peekSource(id string) (*Source, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if source, exists := s.sources[id]; exists {
+		return source, nil
+	}
+	return nil, fmt.Errorf("%s does not exist", id)
+}
+
+// addSink makes a sink available for download, until the uploader is gone
+// or have waited for too long
+func (s *Server) addSink(sink *Sink) error {
+	s.Lock()
+	defer s.Unlock()
+
+	// turn down sinks if we have been shutdown
+	if s.shutdown {
+		return errors.New(s.shutdownMessage)
+	}
+
+	s.sinks[sink.ID] = sink
+	go s.watch(sink)
+	return nil
+}
+
+// removingSource removes its source from the server when closed
+type removingSource struct {
+	*Source
+	server *Server
+}
+
+func (r *removingSource) Close() error {
+	r.server.Lock()
+	delete(r.server.sources, r.ID)
+	r.server.Unlock()
+
+	return r.Source.Close()
+}
+
 // Shutdown sends a message to all clients with transfers that have yet to start
 // and disconnects them
 func (s *Server) Shutdown(msg string) {
@@ -135,14 +269,15 @@ func (s *Server) Shutdown(msg string) {
 	s.shutdownMessage = msg
 
 	for k, v := range s.sinks {
-		// its kind of hacky to address a field of sink directly
-		fmt.Fprint(v.channel.Stderr(), msg)
-		v.channel.SendRequest("exit-status", false, ssh.Marshal(&ExitStatus{Status: 1}))
-		v.channel.Close()
+		v.fail(msg)
 		delete(s.sinks, k)
 	}
 
-	// TODO: Do the same thing for sources at some point
+	// sources are waiting on http uploads - stop them from waiting any longer
+	for k, v := range s.sources {
+		v.Close()
+		delete(s.sources, k)
+	}
 
 	s.Unlock()
 }
@@ -165,12 +300,15 @@ func (s *Server) Listen(listener net.Listener) {
 }
 
 func (s *Server) acceptSCP(c net.Conn) {
-	_, chans, reqs, err := ssh.NewServerConn(c, s.sshConfig)
+	sshConn, chans, reqs, err := ssh.NewServerConn(c, s.sshConfig)
 
 	if err != nil {
 		log.Printf("unable to accept ssh from %s: %s", c.RemoteAddr().String(), err)
+		return
 	}
 
+	conn := newConnection(sshConn)
+
 	// The incoming Request channel must be serviced - but we dont care about them
 	go ssh.DiscardRequests(reqs)
 
@@ -197,66 +335,91 @@ func (s *Server) acceptSCP(c net.Conn) {
 		// "shell" request.
 		go func(in <-chan *ssh.Request) {
 			for req := range in {
+				// modern scp clients use sftp
+				if req.Type == "subsystem" {
+					var subsystem subsystemRequest
+					if ssh.Unmarshal(req.Payload, &subsystem) == nil && subsystem.Name == "sftp" {
+						req.Reply(true, nil)
+						go s.serveSFTP(channel, conn)
+						continue
+					}
+				}
+
 				// exec with payload scp -t || -f is allowed
 				if req.Type != "exec" {
 					req.Reply(false, nil)
 					continue
 				}
 
-				// so - the first 4 bytes are ... i dont know ...
-				payload := string(req.Payload[4:])
-
-				// does the command start with scp ?
-				if !strings.HasPrefix(payload, "scp") {
+				command, err := parseExec(req.Payload)
+				if errors.Is(err, ErrNotSCP) {
 					req.Reply(false, nil)
 					continue
 				}
-
-				// if the user specified "-p" tell him it wont do anything
-				if strings.Index(payload, "-p") >= 0 {
-					fmt.Fprint(channel.Stderr(), "    You seem to have specified -p (preserve create and modified time) - this is ignored\n")
+				if err != nil {
+					log.Printf("unable to handle exec request from %s: %s", conn, err)
+					refuse(req, channel, err)
+					continue
 				}
 
-				// sink (accept files)
-				if strings.Index(payload, "-t") >= 0 {
-					sink, err := NewSink(channel)
-					if err != nil {
-						log.Printf("could not create new sink: %s", err)
+				// source (send files)
+				if command.From {
+					// the id of the source is given either as the id itself or as id/filename
+					id, _, named := strings.Cut(command.Paths[0], "/")
 
-						// tell remote to go away
-						req.Reply(false, nil)
+					source, err := s.takeSource(id)
+					if err != nil {
+						refuse(req, channel, err)
 						continue
 					}
 
-					log.Printf("Sink from %s, with id %s", c.RemoteAddr().String(), sink.ID)
+					log.Printf("Source to %s, with id %s", conn, source.ID)
 
-					s.Lock()
-					// turn down request if we have been shutdown
-					if s.shutdown {
-						s.Unlock()
-						fmt.Fprint(channel.Stderr(), s.shutdownMessage)
-						req.Reply(false, nil)
+					err = source.attach(func(r io.Reader) error {
+						return source.send(channel, !named, r)
+					})
+					if err != nil {
+						refuse(req, channel, err)
 						continue
 					}
-					s.sinks[sink.ID] = sink
-					s.Unlock()
 
 					req.Reply(true, nil)
 					continue
 				}
 
-				// source (send files)
-				if strings.Index(payload, "-f") >= 0 {
+				// sink (accept files)
+				sink, err := NewSink(channel)
+				if err != nil {
+					log.Printf("could not create new sink: %s", err)
 
-					fmt.Fprintf(channel.Stderr(), "Sourcing is not supported ... yet :)")
+					// tell remote to go away
 					req.Reply(false, nil)
 					continue
 				}
+				sink.conn = conn
+				sink.Target = command.Target()
+				sink.several = command.Directory
+
+				log.Printf("Sink from %s, with id %s", conn, sink.ID)
+
+				// turn down the sink if we have been shutdown or the options are bad
+				err = s.register(sink)
+				if err != nil {
+					refuse(req, channel, err)
+					continue
+				}
 
-				// default
-				log.Printf("unable to handle scp requests without -t or -f: \"%s\"", payload)
-				req.Reply(false, nil)
+				req.Reply(true, nil)
 			}
 		}(requests)
 	}
 }
+
+// refuse tells the client why its request failed and closes the channel - the
+// request is accepted, as clients drop stderr of failed requests
+func refuse(req *ssh.Request, channel ssh.Channel, err error) {
+	req.Reply(true, nil)
+	fmt.Fprintf(channel.Stderr(), "    %s\n", err)
+	_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(&ExitStatus{Status: 1}))
+	_ = channel.Close()
+}
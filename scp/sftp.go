@@ -0,0 +1,718 @@
+package scp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fasmide/schttp/packer"
+	"github.com/pkg/sftp"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+func init() {
+	// how many bytes sftp uploads may have spooled to disk at once, files are
+	// spooled while they are uploaded as packers need to know their size
+	viper.SetDefault("SFTP_MAX_SIZE", 4<<30)
+}
+
+// errGone is returned to handlers still waiting when the sftp client goes away
+var errGone = errors.New("sftp client went away")
+
+// sftpSession serves the sftp subsystem
+//
+// Modern scp clients speak sftp - which means we cannot know if the client
+// wants to upload or download until it starts to create files or directories.
+// Uploads are turned into a sink once the client tries to create something,
+// downloads are served from sources.
+type sftpSession struct {
+	sync.Mutex
+
+	server  *Server
+	channel ssh.Channel
+	conn    *connection
+
+	// gone is closed when the client stops sending us requests
+	gone     chan struct{}
+	goneOnce sync.Once
+
+	// sink is created on the first write
+	sink   *Sink
+	stream *sftpStream
+
+	// packer is handed over by the downloader
+	packer packer.Packer
+	err    error
+
+	// path the packer is currently in, relative to /
+	cwd string
+
+	// directories created by the client
+	dirs map[string]os.FileMode
+
+	// files currently open for writing
+	files map[string]*sftpFile
+
+	// bytes of open files spooled to disk, and of files handed to the packer
+	spooled atomic.Int64
+	packed  atomic.Int64
+
+	// maxSpooled and quota limit the bytes above, quota is 0 without a quota
+	maxSpooled int64
+	quota      int64
+
+	// tooLarge makes sure the client is only told once its upload is too large
+	tooLarge sync.Once
+}
+
+// sftpStream implements Stream by handing the packer over to the sftp session
+type sftpStream struct {
+	// packer is set before ready is closed
+	packer packer.Packer
+	ready  chan struct{}
+	done   chan error
+}
+
+// Pack hands p over to the sftp session and waits for the client to finish
+func (s *sftpStream) Pack(p packer.Packer) error {
+	s.packer = p
+	close(s.ready)
+	return <-s.done
+}
+
+// serveSFTP serves the sftp subsystem on a channel until the client closes it
+func (s *Server) serveSFTP(channel ssh.Channel, conn *connection) {
+	quota, _ := conn.limits()
+
+	session := &sftpSession{
+		server:     s,
+		channel:    channel,
+		conn:       conn,
+		gone:       make(chan struct{}),
+		dirs:       make(map[string]os.FileMode),
+		files:      make(map[string]*sftpFile),
+		maxSpooled: s.SFTPMaxSize,
+		quota:      quota,
+	}
+
+	handlers := sftp.Handlers{
+		FileGet:  session,
+		FilePut:  session,
+		FileCmd:  session,
+		FileList: session,
+	}
+
+	server := sftp.NewRequestServer(&sftpChannel{Channel: channel, session: session}, handlers)
+	err := server.Serve()
+
+	session.leave()
+	session.Lock()
+	defer session.Unlock()
+
+	// no files were uploaded - this was a download or nothing at all
+	if session.sink == nil {
+		_, _ = channel.SendRequest("exit-status", false, ssh.Marshal(&ExitStatus{Status: 0}))
+		_ = channel.Close()
+		return
+	}
+
+	// the downloader never showed up
+	if session.packer == nil {
+		s.Lock()
+		delete(s.sinks, session.sink.ID)
+		s.Unlock()
+		_ = channel.Close()
+	}
+
+	// io.EOF is the normal way for sftp clients to end a session
+	if session.err != nil {
+		err = session.err
+	}
+
+	session.stream.done <- err
+}
+
+// sftpChannel tells the session when the client stops sending requests
+type sftpChannel struct {
+	ssh.Channel
+	session *sftpSession
+}
+
+func (c *sftpChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	if err != nil {
+		c.session.leave()
+	}
+	return n, err
+}
+
+// leave marks the client as gone
+func (s *sftpSession) leave() {
+	s.goneOnce.Do(func() { close(s.gone) })
+}
+
+// acquire returns the packer, creating a sink and waiting for a downloader
+// if this is the first upload of the session - must be called with the lock held,
+// which is released while waiting so other requests are answered meanwhile
+func (s *sftpSession) acquire() (packer.Packer, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	if s.packer != nil {
+		return s.packer, nil
+	}
+
+	if s.sink == nil {
+		s.stream = &sftpStream{ready: make(chan struct{}), done: make(chan error, 1)}
+
+		sink, err := newSink(s.channel, s.stream)
+		if err != nil {
+			return nil, fmt.Errorf("could not create new sink: %w", err)
+		}
+		sink.conn = s.conn
+
+		// sftp clients tell the target path with every file, only the username is used
+		err = s.server.register(sink)
+		if err != nil {
+			fmt.Fprintf(s.channel.Stderr(), "    %s\n", err)
+			return nil, err
+		}
+
+		log.Printf("SFTP sink from %s, with id %s", s.conn, sink.ID)
+		s.sink = sink
+	}
+
+	stream := s.stream
+	s.Unlock()
+	select {
+	case <-stream.ready:
+	case <-s.gone:
+	}
+	s.Lock()
+
+	// another request may have failed the packer while we waited
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	select {
+	case <-stream.ready:
+		s.packer = stream.packer
+		return s.packer, nil
+	default:
+		return nil, errGone
+	}
+}
+
+// fail records the first error from the packer, the packer is unusable from now on
+func (s *sftpSession) fail(err error) error {
+	if s.err == nil {
+		s.err = err
+
+		// the downloader is gone, there is no reason to continue
+		_ = s.channel.Close()
+	}
+	return err
+}
+
+// reserve makes room for n more bytes spooled to disk, turning them down if
+// that would exceed the quota of the uploader or the maximum size of the spool
+func (s *sftpSession) reserve(n int64) error {
+	spooled := s.spooled.Add(n)
+
+	var err error
+	switch {
+	case s.quota > 0 && s.packed.Load()+spooled > s.quota:
+		err = ErrQuota
+	case spooled > s.maxSpooled:
+		err = fmt.Errorf("sftp uploads are limited to %d bytes at a time - please use scp -O", s.maxSpooled)
+	}
+
+	if err != nil {
+		s.spooled.Add(-n)
+		s.tooLarge.Do(func() { fmt.Fprintf(s.channel.Stderr(), "    %s\n", err) })
+		return err
+	}
+	return nil
+}
+
+// navigate moves the packer into dir
+func (s *sftpSession) navigate(p packer.Packer, dir string) error {
+	current := components(s.cwd)
+	target := components(dir)
+
+	// find the common prefix
+	common := 0
+	for common < len(current) && common < len(target) && current[common] == target[common] {
+		common++
+	}
+
+	for i := len(current); i > common; i-- {
+		err := p.Exit()
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := common; i < len(target); i++ {
+		mode, exists := s.dirs[path.Join(target[:i+1]...)]
+		if !exists {
+			mode = 0755
+		}
+
+		err := p.Enter(target[i], mode)
+		if err != nil {
+			return err
+		}
+	}
+
+	s.cwd = path.Join(target...)
+	return nil
+}
+
+// Filewrite spools an uploaded file to disk, it is packed once closed
+// as packers need to know its size up front
+func (s *sftpSession) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	fd, err := os.CreateTemp("", "schttp-sftp-")
+	if err != nil {
+		return nil, err
+	}
+
+	f := &sftpFile{File: fd, session: s, name: relative(r.Filepath), mode: openMode(r.Attrs)}
+
+	s.Lock()
+	s.files[f.name] = f
+	s.Unlock()
+
+	return f, nil
+}
+
+// sftpFile is an uploaded file spooled to disk
+type sftpFile struct {
+	*os.File
+	session *sftpSession
+
+	name string
+	mode os.FileMode
+
+	// size is the number of bytes reserved for the file, err is set once
+	// a write have been turned down
+	mu   sync.Mutex
+	size int64
+	err  error
+
+	// times are set by clients preserving them
+	modified, accessed time.Time
+}
+
+// WriteAt spools p to disk, if there is room for it
+func (f *sftpFile) WriteAt(p []byte, off int64) (int, error) {
+	err := f.grow(off + int64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+
+	return f.File.WriteAt(p, off)
+}
+
+// grow reserves room for the file to grow to size bytes
+func (f *sftpFile) grow(size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if size <= f.size {
+		return nil
+	}
+
+	err := f.session.reserve(size - f.size)
+	if err != nil {
+		f.err = err
+		return err
+	}
+
+	f.size = size
+	return nil
+}
+
+// Close packs the spooled file
+func (f *sftpFile) Close() error {
+	defer os.Remove(f.File.Name())
+	defer f.File.Close()
+
+	// the file is off the disk once packed
+	defer func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+
+		f.session.spooled.Add(-f.size)
+		f.session.packed.Add(f.size)
+		f.size = 0
+	}()
+
+	s := f.session
+	s.Lock()
+	defer s.Unlock()
+
+	delete(s.files, f.name)
+
+	// files which did not fit are not packed
+	f.mu.Lock()
+	err := f.err
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.File.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = f.File.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	p, err := s.acquire()
+	if err != nil {
+		return err
+	}
+
+	err = s.navigate(p, path.Dir(f.name))
+	if err != nil {
+		return s.fail(err)
+	}
+
+	if t, ok := p.(packer.Timestamper); ok && !f.modified.IsZero() {
+		t.Times(f.modified, f.accessed)
+	}
+
+	err = p.File(path.Base(f.name), f.mode, fi.Size(), f.File)
+	if err != nil {
+		return s.fail(err)
+	}
+
+	return nil
+}
+
+// Fileread serves sources
+func (s *sftpSession) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	id, _ := splitSource(r.Filepath)
+
+	source, err := s.server.takeSource(id)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+
+	log.Printf("SFTP source to %s, with id %s", s.conn, source.ID)
+
+	reader := &sequentialReaderAt{length: source.Length, gone: s.gone}
+	reader.cond = sync.NewCond(&reader.mu)
+
+	err = source.attach(func(body io.Reader) error {
+		return reader.serve(body)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// Filecmd handles mkdir, other commands are ignored or unsupported
+func (s *sftpSession) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Mkdir":
+		s.Lock()
+		defer s.Unlock()
+
+		p, err := s.acquire()
+		if err != nil {
+			return err
+		}
+
+		name := relative(r.Filepath)
+		mode := os.FileMode(0755)
+		if r.AttrFlags().Permissions {
+			mode = r.Attributes().FileMode().Perm()
+		}
+
+		err = s.navigate(p, path.Dir(name))
+		if err != nil {
+			return s.fail(err)
+		}
+
+		s.dirs[name] = mode
+
+		// enter the directory right away, files are likely to follow
+		err = s.navigate(p, name)
+		if err != nil {
+			return s.fail(err)
+		}
+
+		return nil
+	case "Setstat":
+		s.Lock()
+		defer s.Unlock()
+
+		// clients preserving times sets them before closing the file
+		// - directories have their times set after their contents have
+		//   been uploaded, by then its too late to change them in a stream
+		f, exists := s.files[relative(r.Filepath)]
+		if !exists {
+			return nil
+		}
+
+		flags := r.AttrFlags()
+		attrs := r.Attributes()
+		if flags.Acmodtime {
+			f.modified = time.Unix(int64(attrs.Mtime), 0)
+			f.accessed = time.Unix(int64(attrs.Atime), 0)
+		}
+		if flags.Permissions {
+			f.mode = packer.FileMode(attrs.Mode)
+		}
+
+		return nil
+	}
+
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// Filelist answers stat and list requests for directories created by the client and sources
+func (s *sftpSession) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	name := relative(r.Filepath)
+
+	s.Lock()
+	_, isDir := s.dirs[name]
+	s.Unlock()
+
+	if name == "." || isDir {
+		if r.Method == "List" {
+			return listerAt{}, nil
+		}
+		return listerAt{&fileInfo{name: path.Base(r.Filepath), mode: os.ModeDir | 0755}}, nil
+	}
+
+	// maybe this is a source
+	id, file := splitSource(r.Filepath)
+	source, err := s.server.peekSource(id)
+	if err != nil {
+		return nil, os.ErrNotExist
+	}
+
+	sourceFile := &fileInfo{name: source.Name, mode: source.Mode, size: source.Length}
+
+	// the id itself is a directory containing the file
+	if file == "" {
+		if r.Method == "List" {
+			return listerAt{sourceFile}, nil
+		}
+		return listerAt{&fileInfo{name: id, mode: os.ModeDir | 0755}}, nil
+	}
+
+	if file != source.Name {
+		return nil, os.ErrNotExist
+	}
+
+	return listerAt{sourceFile}, nil
+}
+
+// RealPath resolves paths relative to /
+func (s *sftpSession) RealPath(p string) (string, error) {
+	return path.Clean("/" + p), nil
+}
+
+// relative returns p relative to /
+func relative(p string) string {
+	return path.Clean(strings.TrimPrefix(path.Clean("/"+p), "/"))
+}
+
+// components splits a relative path into its components
+func components(p string) []string {
+	if p == "." || p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
+
+// splitSource splits /id/file into id and file
+func splitSource(p string) (string, string) {
+	parts := strings.SplitN(relative(p), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// openMode finds permissions in the attributes of an open request
+func openMode(attrs []byte) os.FileMode {
+	// attributes are prefixed with flags
+	if len(attrs) < 4 {
+		return 0644
+	}
+
+	flags := binary.BigEndian.Uint32(attrs)
+	attrs = attrs[4:]
+
+	// skip size
+	if flags&0x01 != 0 {
+		if len(attrs) < 8 {
+			return 0644
+		}
+		attrs = attrs[8:]
+	}
+
+	// skip uid and gid
+	if flags&0x02 != 0 {
+		if len(attrs) < 8 {
+			return 0644
+		}
+		attrs = attrs[8:]
+	}
+
+	if flags&0x04 == 0 || len(attrs) < 4 {
+		return 0644
+	}
+
+	return packer.FileMode(binary.BigEndian.Uint32(attrs))
+}
+
+// sequentialReaderAt turns a stream into an io.ReaderAt, sftp clients read
+// in order but may ask for several chunks at once
+type sequentialReaderAt struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	length int64
+	gone   chan struct{}
+
+	// body is handed over when the source starts
+	body io.Reader
+	pos  int64
+	err  error
+
+	// done is closed once all of body have been read
+	done chan struct{}
+}
+
+// serve hands body over to the reader and waits until it has been read
+func (r *sequentialReaderAt) serve(body io.Reader) error {
+	r.mu.Lock()
+	r.body = body
+	r.done = make(chan struct{})
+	done := r.done
+	r.cond.Broadcast()
+	r.mu.Unlock()
+
+	select {
+	case <-done:
+	case <-r.gone:
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pos != r.length {
+		return fmt.Errorf("sftp client read %d of %d bytes", r.pos, r.length)
+	}
+
+	return r.err
+}
+
+func (r *sequentialReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.length {
+		return 0, io.EOF
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// wait for our turn
+	for r.body == nil || r.pos != off {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		if r.body != nil && off < r.pos {
+			return 0, fmt.Errorf("offset %d have already been read", off)
+		}
+
+		select {
+		case <-r.gone:
+			return 0, errGone
+		default:
+		}
+
+		r.wait()
+	}
+
+	if int64(len(p)) > r.length-off {
+		p = p[:r.length-off]
+	}
+
+	n, err := io.ReadFull(r.body, p)
+	r.pos += int64(n)
+	if err != nil {
+		r.err = err
+	}
+
+	if r.pos == r.length || r.err != nil {
+		close(r.done)
+	}
+
+	r.cond.Broadcast()
+
+	if err == nil && r.pos == r.length {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// wait waits for the next broadcast, but no longer than a second so that
+// we will notice if the client went away
+func (r *sequentialReaderAt) wait() {
+	t := time.AfterFunc(time.Second, r.cond.Broadcast)
+	r.cond.Wait()
+	t.Stop()
+}
+
+// listerAt is a static list of files
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(f []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(f, l[offset:])
+	if n < len(f) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// fileInfo describes directories and sources to sftp clients
+type fileInfo struct {
+	name string
+	mode os.FileMode
+	size int64
+}
+
+func (f *fileInfo) Name() string       { return f.name }
+func (f *fileInfo) Size() int64        { return f.size }
+func (f *fileInfo) Mode() os.FileMode  { return f.mode }
+func (f *fileInfo) ModTime() time.Time { return time.Now() }
+func (f *fileInfo) IsDir() bool        { return f.mode.IsDir() }
+func (f *fileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,66 @@
+package scp
+
+import (
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/fasmide/schttp/packer"
+	"github.com/pkg/sftp"
+)
+
+func TestSFTPWaitUnlocked(t *testing.T) {
+	stream := &sftpStream{ready: make(chan struct{}), done: make(chan error, 1)}
+	session := &sftpSession{
+		channel:    discardChannel{},
+		gone:       make(chan struct{}),
+		dirs:       make(map[string]os.FileMode),
+		files:      make(map[string]*sftpFile),
+		maxSpooled: 1024,
+		sink:       &Sink{},
+		stream:     stream,
+	}
+
+	w, err := session.Filewrite(sftp.NewRequest("Put", "/file"))
+	if err != nil {
+		t.Fatalf("unable to write file: %s", err)
+	}
+
+	// closing the first file waits for a downloader
+	closed := make(chan error)
+	go func() { closed <- w.(io.Closer).Close() }()
+
+	listed := make(chan error)
+	go func() {
+		// the file is forgotten just before waiting
+		for waiting := false; !waiting; {
+			session.Lock()
+			waiting = len(session.files) == 0
+			session.Unlock()
+		}
+
+		_, err := session.Filelist(sftp.NewRequest("Stat", "/"))
+		listed <- err
+	}()
+
+	select {
+	case err := <-listed:
+		if err != nil {
+			t.Fatalf("unable to stat while waiting: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("stat blocked while waiting for a downloader")
+	}
+
+	go func() { _ = stream.Pack(packer.NewZip(io.Discard)) }()
+
+	err = <-closed
+	if err != nil {
+		t.Fatalf("unable to close file: %s", err)
+	}
+	if session.packer == nil {
+		t.Fatalf("session did not acquire the packer")
+	}
+	stream.done <- nil
+}
@@ -2,10 +2,12 @@ package scp
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"path"
+	"strings"
 
 	"github.com/fasmide/schttp/packer"
 	"github.com/spf13/viper"
@@ -13,71 +15,210 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+// Stream is able to pack files received from a client
+type Stream interface {
+	Pack(packer.Packer) error
+}
+
 type Sink struct {
-	*ScpStream
+	Stream
 	ID      string
 	channel ssh.Channel
+
+	// Target is the target path given to scp, which may name the archive or hold options
+	Target string
+
+	// Fingerprint is the fingerprint of the key of the uploader, if keys are checked
+	Fingerprint string
+
+	// KeyID and Principals identify uploaders logged in with a certificate
+	KeyID      string
+	Principals []string
+
+	// quota is the maximum number of bytes of the transfer, 0 means no limit
+	quota int64
+
+	// conn is the connection of the uploader
+	conn *connection
+
+	// fanout is set for sinks streamed to several downloaders at once
+	fanout *fanout
+
+	// options are chosen by the uploader
+	options Options
+
+	// password is the bcrypt hash of the download password, if any
+	password []byte
+
+	// recipient is the public key downloads are encrypted to, if any
+	recipient string
+
+	// several is set when scp was given several files or directories to upload (scp -d)
+	several bool
+
+	// progress of the transfer, set up by PackTo or once the downloader is metered
+	progress *progress
+}
+
+// Connected reports whether the uploader is still connected
+func (s *Sink) Connected() bool {
+	if s.conn == nil {
+		return true
+	}
+	return s.conn.Connected()
 }
 
 // SinkBanner is printed out when ready to stream files
 const SinkBanner = `    -----------------------
 
-    One time urls for download
-      %s.zip 
-    or
-      %s.tar.gz
-
+    %s
+%s
+    Or pick a format in your browser:
+      %s
     Or unpack directly on another box:
       curl %s.tar.gz | tar xvz
     (May overwrite existing files)
+
+    Single files are also available as is:
+      %s.raw
 `
 
-// NewSink returns a new initialized *Sink and prints a welcome message
+// EncryptedBanner is printed out instead of SinkBanner when downloads are encrypted
+const EncryptedBanner = `    -----------------------
+
+    %s
+%s
+    Only the recipient is able to decrypt the download, e.g.:
+      curl %s.tar.gz.age | age -d -i ~/.ssh/id_ed25519 | tar xvz
+`
+
+// NewSink returns a new initialized *Sink for an scp client
 func NewSink(c ssh.Channel) (*Sink, error) {
+	return newSink(c, &ScpStream{Writer: c, Reader: bufio.NewReader(c)})
+}
 
+// newSink returns a new initialized *Sink packing from stream
+func newSink(c ssh.Channel, stream Stream) (*Sink, error) {
 	id, err := shortid.Generate()
 	if err != nil {
 		return nil, err
 	}
-	s := &Sink{ID: id, channel: c, ScpStream: &ScpStream{Writer: c, Reader: bufio.NewReader(c)}}
+	return &Sink{ID: id, channel: c, Stream: stream}, nil
+}
 
-	// say hello to our customer
+// greet says hello to our customer, with the limits of the urls
+func (s *Sink) greet(limits string) {
 	url := fmt.Sprintf("%s%s", viper.GetString("ADVERTISE_URL"), path.Join("sink", s.ID))
-	fmt.Fprintf(c.Stderr(), SinkBanner, url, url, url)
+	if s.recipient != "" {
+		fmt.Fprintf(s.channel.Stderr(), EncryptedBanner, limits, formatURLs(url, s.options.Format, true), url)
+		return
+	}
+	urls := formatURLs(url, s.options.Format, false)
+	if s.password != nil {
+		urls += fmt.Sprintf("      %s.%s (encrypted with the password)\n", url, packer.AESZipExtension)
+	}
+	fmt.Fprintf(s.channel.Stderr(), SinkBanner, limits, urls, url, url, url)
+}
 
-	return s, nil
+// Name returns the name of downloaded archives, if the uploader gave one
+func (s *Sink) Name() string {
+	return s.options.Name
+}
+
+// Format returns the extension of the format chosen by the uploader, if any
+func (s *Sink) Format() string {
+	return s.options.Format
+}
+
+// Recipient returns the public key downloads must be encrypted to, if any
+func (s *Sink) Recipient() string {
+	return s.recipient
+}
+
+// Multiple reports whether the upload consists of more than a single file
+func (s *Sink) Multiple() bool {
+	return s.several
+}
+
+// Remaining returns how many downloads remain after this one, sinks are only
+// downloaded once unless fanned out
+func (s *Sink) Remaining() int {
+	if s.fanout != nil {
+		return s.fanout.remaining()
+	}
+	return 0
 }
 
-// PackTo accepts a PackerCloser and adds files from the transfer to it
+// Announce tells the uploader who is downloading the transfer, and in which format
+func (s *Sink) Announce(remote, userAgent, format string) {
+	// the user agent is up to the downloader, keep it from messing with the terminal
+	fmt.Fprintf(s.channel.Stderr(), "    Downloading to %s (%q) as %s\n", remote, userAgent, format)
+}
+
+// Meter returns w counting the bytes delivered to the downloader, the uploader
+// is told about them along with the bytes received
+func (s *Sink) Meter(w io.Writer) io.Writer {
+	if s.progress == nil {
+		s.progress = newProgress()
+	}
+	s.progress.metered = true
+
+	return &progressWriter{Writer: w, progress: s.progress}
+}
+
+// PackTo accepts a PackerCloser and adds files from the transfer to it, while
+// the uploader is told about the progress
 func (s *Sink) PackTo(p packer.PackerCloser) error {
+	var target packer.Packer = p
+	if s.quota > 0 {
+		target = &quotaPacker{Packer: p, remaining: s.quota}
+	}
+
+	if s.progress == nil {
+		s.progress = newProgress()
+	}
+	progress := s.progress
+	target = &progressPacker{Packer: target, progress: progress}
 
-	err := s.Pack(p)
+	done := make(chan struct{})
+	if interval := viper.GetDuration("PROGRESS_INTERVAL"); interval > 0 {
+		go progress.report(s.channel.Stderr(), interval, done)
+	}
+
+	err := s.Pack(target)
+	close(done)
 	if err != nil && err != io.EOF {
 		log.Printf("Sink error: %s", err)
 
+		if errors.Is(err, ErrQuota) {
+			fmt.Fprintf(s.channel.Stderr(), "    %s\n", err)
+		}
+
 		// indicate to the remote scp client we have failed
 		_, _ = s.channel.SendRequest("exit-status", false, ssh.Marshal(&ExitStatus{Status: 1}))
 
 		// close stuff
 		_ = s.channel.Close()
-		_ = p.Close()
+		abort(p)
 		return err
 
 	}
 
 	err = p.Close()
 	if err != nil {
-		log.Printf("Sink error: could not close zip file: %s", err)
+		log.Printf("Sink error: could not finish packing: %s", err)
 
 		// indicate to the remote scp client we have failed
 		_, _ = s.channel.SendRequest("exit-status", false, ssh.Marshal(&ExitStatus{Status: 1}))
 
-		// close stuff
+		// close stuff - what was packed must not be left behind, e.g. stored
 		_ = s.channel.Close()
-		_ = p.Close()
+		abort(p)
 		return err
 	}
 
+	fmt.Fprint(s.channel.Stderr(), progress.summary())
+
 	// indicate to remote scp client we have succeded
 	_, _ = s.channel.SendRequest("exit-status", false, ssh.Marshal(&ExitStatus{Status: 0}))
 	_ = s.channel.Close()
@@ -85,3 +226,59 @@ func (s *Sink) PackTo(p packer.PackerCloser) error {
 	// its really not true zero bytes where written
 	return nil
 }
+
+// Cancel tells the uploader the download failed before anything was packed
+func (s *Sink) Cancel(reason string) {
+	log.Printf("Sink %s: download cancelled: %s", s.ID, reason)
+	s.fail(fmt.Sprintf("    Download failed: %s\n", reason))
+}
+
+// failer is implemented by streams able to tell the client the transfer have failed
+type failer interface {
+	Fail(msg string) error
+}
+
+// fail tells the uploader why the transfer failed and ends the session
+func (s *Sink) fail(msg string) {
+	if f, ok := s.Stream.(failer); ok {
+		_ = f.Fail(msg)
+	} else {
+		fmt.Fprint(s.channel.Stderr(), msg)
+	}
+
+	_, _ = s.channel.SendRequest("exit-status", false, ssh.Marshal(&ExitStatus{Status: 1}))
+	_ = s.channel.Close()
+}
+
+// aborter is implemented by packers able to throw away what was packed so far
+type aborter interface {
+	Abort() error
+}
+
+// abort aborts p if possible, otherwise it is closed
+func abort(p packer.PackerCloser) {
+	if a, ok := p.(aborter); ok {
+		_ = a.Abort()
+		return
+	}
+	_ = p.Close()
+}
+
+// formatURLs lists url with every available format, the preferred one first
+func formatURLs(url string, preferred string, encrypted bool) string {
+	suffix := ""
+	if encrypted {
+		suffix = "." + packer.AgeExtension
+	}
+
+	var b strings.Builder
+	if preferred != "" {
+		fmt.Fprintf(&b, "      %s.%s%s\n", url, preferred, suffix)
+	}
+	for _, f := range packer.Formats() {
+		if f.Extension != preferred {
+			fmt.Fprintf(&b, "      %s.%s%s\n", url, f.Extension, suffix)
+		}
+	}
+	return b.String()
+}
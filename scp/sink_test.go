@@ -0,0 +1,68 @@
+package scp
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/fasmide/schttp/packer"
+	"golang.org/x/crypto/ssh"
+)
+
+// discardChannel is a channel to an uploader which went quiet
+type discardChannel struct{}
+
+func (discardChannel) Read([]byte) (int, error)    { return 0, io.EOF }
+func (discardChannel) Write(b []byte) (int, error) { return len(b), nil }
+func (discardChannel) Close() error                { return nil }
+func (discardChannel) CloseWrite() error           { return nil }
+func (discardChannel) Stderr() io.ReadWriter       { return discardStderr{} }
+func (discardChannel) SendRequest(string, bool, []byte) (bool, error) {
+	return true, nil
+}
+
+type discardStderr struct{}
+
+func (discardStderr) Read([]byte) (int, error)    { return 0, io.EOF }
+func (discardStderr) Write(b []byte) (int, error) { return len(b), nil }
+
+// emptyStream packs nothing at all
+type emptyStream struct{}
+
+func (emptyStream) Pack(packer.Packer) error { return nil }
+
+// unclosablePacker fails to close, as a spool failing to store the manifest
+type unclosablePacker struct {
+	packer.Packer
+	closed, aborted int
+}
+
+var errUnclosable = errors.New("unable to close")
+
+func (p *unclosablePacker) Close() error {
+	p.closed++
+	return errUnclosable
+}
+
+func (p *unclosablePacker) Abort() error {
+	p.aborted++
+	return nil
+}
+
+func TestPackToCloseFails(t *testing.T) {
+	sink, err := newSink(ssh.Channel(discardChannel{}), emptyStream{})
+	if err != nil {
+		t.Fatalf("unable to create sink: %s", err)
+	}
+
+	p := &unclosablePacker{}
+	err = sink.PackTo(p)
+	if !errors.Is(err, errUnclosable) {
+		t.Fatalf("expected the close error, got %v", err)
+	}
+
+	// closing again could store what the uploader was told failed
+	if p.closed != 1 || p.aborted != 1 {
+		t.Fatalf("packer closed %d and aborted %d times, expected once each", p.closed, p.aborted)
+	}
+}
@@ -1,27 +1,152 @@
 package scp
 
 import (
+	"bufio"
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"sync"
 
 	"github.com/teris-io/shortid"
 
 	"golang.org/x/crypto/ssh"
 )
 
+// ErrSourceClosed is returned by ReadFrom if the source was closed before
+// any scp client showed up to fetch it
+var ErrSourceClosed = errors.New("source closed before it was fetched")
+
+// ErrSourceName is returned by NewSource for names which are not plain file names
+var ErrSourceName = errors.New("name must be a file name without control characters")
+
+// Source is a file uploaded over http, waiting for an scp client to fetch it
 type Source struct {
-	ID      string
-	channel ssh.Channel
+	ID     string
+	Name   string
+	Mode   os.FileMode
+	Length int64
+
+	// fetches are handed over by the ssh server when an scp client asks for this source
+	fetches chan func(io.Reader) error
+
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
-func NewSource(c ssh.Channel) (*Source, error) {
+// NewSource returns a new *Source for a file with the given name and length
+func NewSource(name string, length int64) (*Source, error) {
+	// the name ends up in the scp record sent to the client
+	if !sourceName(name) {
+		return nil, fmt.Errorf("%q: %w", name, ErrSourceName)
+	}
+
 	id, err := shortid.Generate()
 	if err != nil {
 		return nil, err
 	}
 
-	return &Source{ID: id, channel: c}, nil
+	return &Source{
+		ID:      id,
+		Name:    name,
+		Mode:    0644,
+		Length:  length,
+		fetches: make(chan func(io.Reader) error, 1),
+		closed:  make(chan struct{}),
+	}, nil
+}
+
+// sourceName reports whether name is usable as the name of a source: a file name
+// which is not "." or "..", and without slashes or control characters
+func sourceName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+
+	for _, r := range name {
+		if r == '/' || r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// attach hands a function fetching the source over to the source, it is
+// called with the uploaded contents once the uploader is ready
+func (s *Source) attach(fetch func(io.Reader) error) error {
+	select {
+	case s.fetches <- fetch:
+		return nil
+	case <-s.closed:
+		return ErrSourceClosed
+	}
 }
 
+// Close stops the source from waiting on an scp client
+func (s *Source) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+// ReadFrom waits for an scp client to fetch this source and then streams
+// Length bytes from r to it
 func (s *Source) ReadFrom(r io.Reader) (int64, error) {
-	return 0, nil
+	var fetch func(io.Reader) error
+	select {
+	case fetch = <-s.fetches:
+	case <-s.closed:
+		return 0, ErrSourceClosed
+	}
+
+	// count what was actually read from r
+	counter := &countingReader{Reader: io.LimitReader(r, s.Length)}
+
+	err := fetch(counter)
+	if err != nil {
+		return counter.n, fmt.Errorf("unable to source %s: %w", s.ID, err)
+	}
+
+	return counter.n, nil
+}
+
+// send streams the source to a scp client using the scp protocol
+//
+// if the client asked for the id itself, the file is wrapped in a directory
+// named after the id - otherwise the scp client will complain the filename
+// does not match its request
+func (s *Source) send(c ssh.Channel, directory bool, r io.Reader) error {
+	stream := &ScpStream{Writer: c, Reader: bufio.NewReader(c)}
+	file := &Command{Type: Create, Name: s.Name, Mode: s.Mode, Length: s.Length}
+
+	var err error
+	if directory {
+		err = stream.SendDirectory(&Command{Type: Directory, Name: s.ID, Mode: 0755}, file, r)
+	} else {
+		err = stream.Send(file, r)
+	}
+
+	if err != nil {
+		// indicate to the remote scp client we have failed
+		_, _ = c.SendRequest("exit-status", false, ssh.Marshal(&ExitStatus{Status: 1}))
+		_ = c.Close()
+		return err
+	}
+
+	// indicate to remote scp client we have succeded
+	_, _ = c.SendRequest("exit-status", false, ssh.Marshal(&ExitStatus{Status: 0}))
+	_ = c.Close()
+
+	return nil
+}
+
+// countingReader counts bytes read through it
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	c.n += int64(n)
+	return n, err
 }
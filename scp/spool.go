@@ -0,0 +1,195 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fasmide/schttp/spool"
+	"github.com/fasmide/schttp/storage"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	// spool every transfer, not only those asking for it with the spool option
+	viper.SetDefault("SPOOL", false)
+
+	// where spooled transfers are stored, either "directory" or "s3"
+	viper.SetDefault("STORAGE", "directory")
+	viper.SetDefault("SPOOL_DIRECTORY", filepath.Join(os.TempDir(), "schttp"))
+
+	// S3 compatible object store, buckets are addressed path style
+	viper.SetDefault("S3_ENDPOINT", "https://s3.amazonaws.com")
+	viper.SetDefault("S3_BUCKET", "schttp")
+	viper.SetDefault("S3_REGION", "us-east-1")
+	viper.SetDefault("S3_ACCESS_KEY_ID", "")
+	viper.SetDefault("S3_SECRET_ACCESS_KEY", "")
+
+	// how long spooled transfers are kept
+	viper.SetDefault("SPOOL_TTL", "24h")
+
+	// the maximum number of bytes stored at once, 0 means no limit
+	viper.SetDefault("SPOOL_MAX_SIZE", 10<<30)
+
+	// how long a download served in ranges may be left unfinished before
+	// it no longer counts against the downloads of the transfer
+	viper.SetDefault("SPOOL_RESUME_TIMEOUT", "10m")
+}
+
+// SpoolBanner is printed out when a transfer is stored on the server
+const SpoolBanner = `
+    The transfer is stored on the server
+    - no need to wait for the download
+`
+
+// newStore returns the configured storage backend
+func newStore() (storage.Store, error) {
+	switch viper.GetString("STORAGE") {
+	case "directory":
+		return storage.NewDir(viper.GetString("SPOOL_DIRECTORY"))
+	case "s3":
+		return &storage.S3{
+			Endpoint:        viper.GetString("S3_ENDPOINT"),
+			Bucket:          viper.GetString("S3_BUCKET"),
+			Region:          viper.GetString("S3_REGION"),
+			AccessKeyID:     viper.GetString("S3_ACCESS_KEY_ID"),
+			SecretAccessKey: viper.GetString("S3_SECRET_ACCESS_KEY"),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown storage %q, use directory or s3", viper.GetString("STORAGE"))
+}
+
+// newSpool sets up the spool from configuration and expires old transfers
+// every minute
+func newSpool() (*spool.Spool, error) {
+	store, err := newStore()
+	if err != nil {
+		return nil, err
+	}
+
+	sp, err := spool.New(
+		store,
+		viper.GetDuration("SPOOL_TTL"),
+		viper.GetInt64("SPOOL_MAX_SIZE"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	sp.Idle = viper.GetDuration("SPOOL_RESUME_TIMEOUT")
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			sp.Expire()
+		}
+	}()
+
+	return sp, nil
+}
+
+// register makes a sink available for download, either waiting for a
+// downloader or - if spooled - stored right away
+//
+// Options are read from the username and the target path of scp, if any.
+// Sinks are spooled if asked to, or if they must outlive a single download,
+// while fanout sinks wait for several downloaders
+func (s *Server) register(sink *Sink) error {
+	options, err := ParseOptions(sink.conn.User())
+	if err != nil {
+		return err
+	}
+
+	err = options.ParseTarget(sink.Target)
+	if err != nil {
+		return err
+	}
+	sink.options = options
+
+	sink.Fingerprint = sink.conn.fingerprint()
+	sink.KeyID = sink.conn.keyID()
+	sink.Principals = sink.conn.principals()
+	quota, maxTTL := sink.conn.limits()
+	sink.quota = quota
+
+	// the key of the uploader may limit how long transfers are kept
+	ttl := options.TTL
+	if maxTTL > 0 && ttl > maxTTL {
+		return fmt.Errorf("ttl: your key allows at most %s", maxTTL)
+	}
+	if maxTTL > 0 && ttl == 0 {
+		ttl = maxTTL
+	}
+
+	password, err := sink.conn.password(options)
+	if err != nil {
+		return err
+	}
+
+	sink.password, err = hashPassword(password)
+	if err != nil {
+		return fmt.Errorf("password: %w", err)
+	}
+
+	sink.recipient, err = resolveRecipient(options.Recipient, s.RecipientDirectory)
+	if err != nil {
+		return err
+	}
+
+	if options.Fanout > 1 {
+		sink.fanout = newFanout(sink, options.Fanout, func() {
+			s.Lock()
+			delete(s.sinks, sink.ID)
+			s.Unlock()
+		})
+		sink.greet(fmt.Sprintf("Urls for %d simultaneous downloads", options.Fanout))
+		return s.addSink(sink)
+	}
+
+	spooled := options.Spool || options.Downloads > 1 || options.TTL > 0 || viper.GetBool("SPOOL")
+	if !spooled {
+		sink.greet("One time urls for download")
+		return s.addSink(sink)
+	}
+
+	s.Lock()
+	shutdown := s.shutdown
+	s.Unlock()
+	if shutdown {
+		return errors.New(s.shutdownMessage)
+	}
+
+	w, err := s.spool.Create(sink.ID, spool.Options{
+		Downloads: options.Downloads,
+		TTL:       ttl,
+		Name:      options.Name,
+		Format:    options.Format,
+		Password:  sink.password,
+		Recipient: sink.recipient,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to spool transfer: %w", err)
+	}
+
+	downloads := "one download"
+	if options.Downloads > 1 {
+		downloads = fmt.Sprintf("%d downloads", options.Downloads)
+	}
+	sink.greet(fmt.Sprintf("Urls for %s, until %s", downloads, w.Expires().UTC().Format("2006-01-02 15:04 MST")))
+	fmt.Fprint(sink.channel.Stderr(), SpoolBanner)
+
+	log.Printf("Spooling sink %s", sink.ID)
+
+	go func() {
+		err := sink.PackTo(w)
+		if err != nil {
+			log.Printf("Spooling sink %s failed: %s", sink.ID, err)
+			return
+		}
+		log.Printf("Spooled sink %s", sink.ID)
+	}()
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package spool
+
+import (
+	"os"
+	"time"
+)
+
+// Manifest describes a stored transfer, it is stored as <id>/manifest.json
+// next to the contents of its files - once it exists the transfer is complete
+type Manifest struct {
+	ID      string    `json:"id"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+
+	// Downloads is how many times the transfer may be downloaded
+	Downloads  int `json:"downloads"`
+	Downloaded int `json:"downloaded"`
+
+	// Name and Format are the name and default format of downloaded archives
+	Name   string `json:"name,omitempty"`
+	Format string `json:"format,omitempty"`
+
+	// Password is the bcrypt hash of the download password, if any
+	Password []byte `json:"password,omitempty"`
+
+	// Recipient is the public key downloads are encrypted to, if any
+	Recipient string `json:"recipient,omitempty"`
+
+	// Entries are in the order they were uploaded, directories before their contents
+	Entries []Entry `json:"entries"`
+}
+
+// Entry is a file or directory of a stored transfer
+type Entry struct {
+	// Path is slash separated and relative to the root of the transfer
+	Path string      `json:"path"`
+	Mode os.FileMode `json:"mode"`
+	Size int64       `json:"size"`
+
+	// CRC32 is the IEEE CRC-32 of the file contents
+	CRC32 uint32 `json:"crc32,omitempty"`
+
+	Modified time.Time `json:"modified,omitzero"`
+	Accessed time.Time `json:"accessed,omitzero"`
+
+	// Object is the key of the file contents, directories have none
+	Object string `json:"object,omitempty"`
+}
+
+// manifestKey returns the key of the manifest of id
+func manifestKey(id string) string {
+	return id + "/manifest.json"
+}
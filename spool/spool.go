@@ -0,0 +1,904 @@
+package spool
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fasmide/schttp/packer"
+	"github.com/fasmide/schttp/storage"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// ErrFull is returned when storing a file would exceed the size cap of the spool
+	ErrFull = errors.New("spool is full")
+
+	// ErrExpired is returned for transfers which have expired, but are yet to be removed
+	ErrExpired = errors.New("transfer have expired")
+)
+
+// Spool keeps transfers in a storage.Store until they are downloaded or expire
+type Spool struct {
+	Store storage.Store
+
+	// TTL is how long transfers are kept, at most
+	TTL time.Duration
+
+	// MaxSize is the maximum number of bytes stored at once, zero means no limit
+	MaxSize int64
+
+	// Idle is how long a download served in ranges stays claimed without
+	// being read, waiting to be resumed
+	Idle time.Duration
+
+	mu   sync.Mutex
+	used int64
+
+	// inflight counts downloads in progress by id
+	inflight map[string]int
+
+	// readers counts open archive readers by id, transfers being removed are
+	// kept until every reader is closed
+	readers  map[string]int
+	removing map[string]bool
+	closed   *sync.Cond
+
+	// claims are downloads served in ranges, by their ETag
+	claims map[string]*claim
+
+	// counting serializes updates of manifests with downloads being claimed
+	counting sync.Mutex
+}
+
+// New returns a *Spool storing transfers in store, counting the size of
+// transfers already stored
+func New(store storage.Store, ttl time.Duration, maxSize int64) (*Spool, error) {
+	s := &Spool{
+		Store:    store,
+		TTL:      ttl,
+		MaxSize:  maxSize,
+		Idle:     10 * time.Minute,
+		inflight: make(map[string]int),
+		readers:  make(map[string]int),
+		removing: make(map[string]bool),
+		claims:   make(map[string]*claim),
+	}
+	s.closed = sync.NewCond(&s.mu)
+
+	objects, err := store.List("")
+	if err != nil {
+		return nil, fmt.Errorf("unable to count spool size: %w", err)
+	}
+
+	for _, o := range objects {
+		s.used += o.Size
+	}
+
+	return s, nil
+}
+
+// validate makes sure ids cannot escape their prefix in the store
+func validate(id string) error {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return fmt.Errorf("invalid id %q", id)
+	}
+	return nil
+}
+
+// reserve reserves space for size bytes
+func (s *Spool) reserve(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.MaxSize > 0 && s.used+size > s.MaxSize {
+		return ErrFull
+	}
+
+	s.used += size
+	return nil
+}
+
+// unreserve releases space reserved for bytes which were never stored
+func (s *Spool) unreserve(size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.used -= size
+}
+
+// remove deletes every object of a transfer and releases its space, once
+// every reader of the transfer has been closed
+func (s *Spool) remove(id string) error {
+	s.mu.Lock()
+	s.removing[id] = true
+	for s.readers[id] > 0 {
+		s.closed.Wait()
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.removing, id)
+		s.mu.Unlock()
+	}()
+
+	objects, err := s.Store.List(id + "/")
+	if err != nil {
+		return err
+	}
+
+	// without its manifest the transfer is gone, even if deleting the rest fails
+	err = s.Store.Delete(manifestKey(id))
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	for _, o := range objects {
+		size += o.Size
+		if o.Key == manifestKey(id) {
+			continue
+		}
+
+		e := s.Store.Delete(o.Key)
+		if e != nil {
+			err = e
+		}
+	}
+
+	s.mu.Lock()
+	s.used -= size
+	s.mu.Unlock()
+
+	return err
+}
+
+// open registers a reader of a transfer, unless it is being removed
+func (s *Spool) open(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.removing[id] {
+		return fmt.Errorf("%s does not exist", id)
+	}
+	s.readers[id]++
+	return nil
+}
+
+// close unregisters a reader of a transfer
+func (s *Spool) close(id string) {
+	s.mu.Lock()
+	s.readers[id]--
+	if s.readers[id] <= 0 {
+		delete(s.readers, id)
+	}
+	s.mu.Unlock()
+
+	s.closed.Broadcast()
+}
+
+// Options describe a new transfer
+type Options struct {
+	// Downloads is how many times the transfer may be downloaded, at least once
+	Downloads int
+
+	// TTL is how long the transfer is kept - zero, or above the TTL of the
+	// spool, is the TTL of the spool
+	TTL time.Duration
+
+	// Name and Format are the name and default format of downloaded archives
+	Name   string
+	Format string
+
+	// Password is the bcrypt hash of the download password, if any
+	Password []byte
+
+	// Recipient is the public key downloads are encrypted to, if any
+	Recipient string
+}
+
+// Create returns a writer storing a new transfer, the transfer is available
+// once the writer is closed
+func (s *Spool) Create(id string, o Options) (*Writer, error) {
+	err := validate(id)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := o.TTL
+	if ttl <= 0 || ttl > s.TTL {
+		ttl = s.TTL
+	}
+
+	m := &Manifest{
+		ID:        id,
+		Expires:   time.Now().Add(ttl),
+		Downloads: max(o.Downloads, 1),
+		Name:      o.Name,
+		Format:    o.Format,
+		Password:  o.Password,
+		Recipient: o.Recipient,
+	}
+
+	return &Writer{spool: s, manifest: m}, nil
+}
+
+// Stat returns a stored transfer without claiming it
+func (s *Spool) Stat(id string) (*Transfer, error) {
+	err := validate(id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	removing := s.removing[id]
+	s.mu.Unlock()
+	if removing {
+		return nil, fmt.Errorf("%s does not exist", id)
+	}
+
+	r, err := s.Store.Get(manifestKey(id), 0)
+	if errors.Is(err, storage.ErrNotExist) {
+		return nil, fmt.Errorf("%s does not exist", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to get manifest of %s: %w", id, err)
+	}
+	defer r.Close()
+
+	m := &Manifest{}
+	err = json.NewDecoder(r).Decode(m)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read manifest of %s: %w", id, err)
+	}
+
+	// expired transfers may linger until the next expiry run
+	if time.Now().After(m.Expires) {
+		return nil, fmt.Errorf("%s does not exist: %w", id, ErrExpired)
+	}
+
+	return &Transfer{Manifest: m, spool: s, remaining: m.Downloads - m.Downloaded - 1}, nil
+}
+
+// Take claims a download of a stored transfer, once downloaded as many times
+// as allowed it is removed
+func (s *Spool) Take(id string) (*Transfer, error) {
+	// the manifest must not be counted between reading it and claiming the download
+	s.counting.Lock()
+	defer s.counting.Unlock()
+
+	t, err := s.Stat(id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// downloads in progress count until they have failed
+	t.remaining -= s.inflight[id]
+	if t.remaining < 0 {
+		return nil, fmt.Errorf("%s does not exist", id)
+	}
+	s.inflight[id]++
+	t.taken = true
+
+	return t, nil
+}
+
+// release ends a download of a taken transfer, counting it if downloaded - once
+// downloaded as many times as allowed the transfer is removed
+func (s *Spool) release(id string, downloaded bool) {
+	// the download is counted before it stops being in progress, Take sees
+	// it as one or the other
+	s.counting.Lock()
+	var last bool
+	var err error
+	if downloaded {
+		last, err = s.increment(id)
+	}
+
+	s.mu.Lock()
+	s.inflight[id]--
+	if s.inflight[id] <= 0 {
+		delete(s.inflight, id)
+	}
+	s.mu.Unlock()
+	s.counting.Unlock()
+
+	// removing waits for other readers, which must not hold up counting of other transfers
+	if err == nil && last {
+		err = s.remove(id)
+	}
+	if err != nil {
+		log.Printf("Spool: unable to count download of %s: %s", id, err)
+	}
+}
+
+// increment increments Downloaded of the manifest of id, last is true if the
+// transfer must be removed - must be called with counting held
+func (s *Spool) increment(id string) (last bool, err error) {
+	t, err := s.Stat(id)
+	if err != nil {
+		return false, err
+	}
+
+	t.Downloaded++
+	if t.Downloaded >= t.Downloads {
+		// nothing new may read the transfer while it waits to be removed
+		s.mu.Lock()
+		s.removing[id] = true
+		s.mu.Unlock()
+		return true, nil
+	}
+
+	b, err := json.Marshal(t.Manifest)
+	if err != nil {
+		return false, err
+	}
+
+	return false, s.Store.Put(manifestKey(id), bytes.NewReader(b), int64(len(b)))
+}
+
+// Expire removes expired transfers, and gives up claimed downloads which
+// have been idle for too long
+func (s *Spool) Expire() {
+	s.unclaim()
+
+	objects, err := s.Store.List("")
+	if err != nil {
+		log.Printf("Spool: unable to expire transfers: %s", err)
+		return
+	}
+
+	// transfers without manifest are expired by the age of their newest object
+	// - if they are too old they are very likely left behind by a crash
+	newest := make(map[string]time.Time)
+	complete := make(map[string]bool)
+	for _, o := range objects {
+		id, _, _ := strings.Cut(o.Key, "/")
+		if o.Modified.After(newest[id]) {
+			newest[id] = o.Modified
+		}
+		if o.Key == manifestKey(id) {
+			complete[id] = true
+		}
+	}
+
+	for id, modified := range newest {
+		s.mu.Lock()
+		inflight := s.inflight[id] > 0 || s.readers[id] > 0
+		s.mu.Unlock()
+
+		if inflight {
+			continue
+		}
+
+		if complete[id] {
+			// the store failing to read the manifest does not make the transfer expire
+			_, err := s.Stat(id)
+			if !errors.Is(err, ErrExpired) {
+				if err != nil {
+					log.Printf("Spool: unable to check expiry of %s: %s", id, err)
+				}
+				continue
+			}
+		} else if time.Since(modified) < s.TTL {
+			continue
+		}
+
+		log.Printf("Spool: expiring %s", id)
+		err = s.remove(id)
+		if err != nil {
+			log.Printf("Spool: unable to remove %s: %s", id, err)
+		}
+	}
+}
+
+// claim is a download claimed by Take, which is served in ranges of an
+// archive - possibly by several requests at once
+type claim struct {
+	key      string
+	transfer *Transfer
+	size     int64
+
+	// covered holds the ranges of the archive served so far, sorted and merged
+	covered [][2]int64
+
+	// readers is the number of open archives serving the claim
+	readers int
+	used    time.Time
+}
+
+// claim claims a download of the archive of id identified by key, resuming
+// a download of key already claimed
+func (s *Spool) claim(key, id string, size int64) (*claim, error) {
+	s.mu.Lock()
+	c, exists := s.claims[key]
+	if exists {
+		c.readers++
+		c.used = time.Now()
+	}
+	s.mu.Unlock()
+
+	if exists {
+		return c, nil
+	}
+
+	t, err := s.Take(id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	c, exists = s.claims[key]
+	if exists {
+		c.readers++
+		c.used = time.Now()
+	} else {
+		c = &claim{key: key, transfer: t, size: size, readers: 1, used: time.Now()}
+		s.claims[key] = c
+	}
+	s.mu.Unlock()
+
+	// another request of the same client may have claimed it meanwhile
+	if exists {
+		s.release(id, false)
+	}
+
+	return c, nil
+}
+
+// cover records that the bytes from start to end of a claimed archive have
+// been served, it returns true the first time the whole archive is covered
+func (s *Spool) cover(c *claim, start, end int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c.used = time.Now()
+	if s.claims[c.key] != c {
+		return false
+	}
+
+	merged := make([][2]int64, 0, len(c.covered)+1)
+	for _, r := range c.covered {
+		if r[1] < start || r[0] > end {
+			merged = append(merged, r)
+			continue
+		}
+		start, end = min(start, r[0]), max(end, r[1])
+	}
+	merged = append(merged, [2]int64{start, end})
+	sort.Slice(merged, func(i, j int) bool { return merged[i][0] < merged[j][0] })
+	c.covered = merged
+
+	if len(merged) == 1 && merged[0][0] == 0 && merged[0][1] >= c.size {
+		delete(s.claims, c.key)
+		return true
+	}
+	return false
+}
+
+// unclaim gives up claims which have been idle for too long, or whose transfer have expired
+func (s *Spool) unclaim() {
+	var idle []*claim
+
+	s.mu.Lock()
+	for key, c := range s.claims {
+		if c.readers > 0 {
+			continue
+		}
+		if time.Since(c.used) > s.Idle || time.Now().After(c.transfer.Expires) {
+			delete(s.claims, key)
+			idle = append(idle, c)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, c := range idle {
+		log.Printf("Spool: giving up idle download of %s", c.transfer.ID)
+		s.release(c.transfer.ID, false)
+	}
+}
+
+// Writer stores files of a transfer, it implements packer.PackerCloser
+type Writer struct {
+	spool    *Spool
+	manifest *Manifest
+
+	// Path is the current directory, relative to the root of the transfer
+	Path string
+
+	// times for the next file or directory
+	modified, accessed time.Time
+}
+
+// Expires returns when the transfer expires
+func (w *Writer) Expires() time.Time {
+	return w.manifest.Expires
+}
+
+// Times sets modified and accessed times of the next file or directory
+func (w *Writer) Times(modified, accessed time.Time) {
+	w.modified = modified
+	w.accessed = accessed
+}
+
+// entry returns a new entry for name in the current directory
+func (w *Writer) entry(name string, mode os.FileMode, size int64) (Entry, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return Entry{}, fmt.Errorf("invalid name %q", name)
+	}
+
+	e := Entry{
+		Path:     path.Join(w.Path, name),
+		Mode:     mode,
+		Size:     size,
+		Modified: w.modified,
+		Accessed: w.accessed,
+	}
+
+	w.modified = time.Time{}
+	w.accessed = time.Time{}
+
+	return e, nil
+}
+
+func (w *Writer) File(name string, mode os.FileMode, size int64, r io.Reader) error {
+	e, err := w.entry(name, mode, size)
+	if err != nil {
+		return err
+	}
+
+	err = w.spool.reserve(size)
+	if err != nil {
+		return err
+	}
+
+	e.Object = fmt.Sprintf("%s/files/%d", w.manifest.ID, len(w.manifest.Entries))
+	crc := crc32.NewIEEE()
+	err = w.spool.Store.Put(e.Object, io.TeeReader(r, crc), size)
+	if err != nil {
+		w.spool.unreserve(size)
+		return fmt.Errorf("unable to store file contents: %w", err)
+	}
+	e.CRC32 = crc.Sum32()
+
+	w.manifest.Entries = append(w.manifest.Entries, e)
+	return nil
+}
+
+func (w *Writer) Enter(name string, mode os.FileMode) error {
+	e, err := w.entry(name, mode|os.ModeDir, 0)
+	if err != nil {
+		return err
+	}
+
+	w.manifest.Entries = append(w.manifest.Entries, e)
+	w.Path = e.Path
+	return nil
+}
+
+func (w *Writer) Exit() error {
+	if w.Path == "" {
+		return fmt.Errorf("unable to leave the root of the transfer")
+	}
+
+	w.Path = path.Dir(w.Path)
+	if w.Path == "." {
+		w.Path = ""
+	}
+	return nil
+}
+
+// Close stores the manifest, making the transfer available for download
+func (w *Writer) Close() error {
+	w.manifest.Created = time.Now()
+
+	b, err := json.Marshal(w.manifest)
+	if err != nil {
+		return err
+	}
+
+	err = w.spool.reserve(int64(len(b)))
+	if err != nil {
+		return err
+	}
+
+	err = w.spool.Store.Put(manifestKey(w.manifest.ID), bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		w.spool.unreserve(int64(len(b)))
+		return err
+	}
+	return nil
+}
+
+// Abort removes a transfer which failed
+func (w *Writer) Abort() error {
+	return w.spool.remove(w.manifest.ID)
+}
+
+// Transfer is a stored transfer, it implements packer.PackerTo
+type Transfer struct {
+	*Manifest
+	spool *Spool
+
+	// taken is set if a download have been claimed by Take
+	taken bool
+
+	// remaining downloads after this one
+	remaining int
+}
+
+// Stored reports that the transfer is stored and does not depend on the uploader
+func (t *Transfer) Stored() bool {
+	return true
+}
+
+// Expiry returns when the transfer expires
+func (t *Transfer) Expiry() time.Time {
+	return t.Expires
+}
+
+// Remaining returns how many downloads remain after this one
+func (t *Transfer) Remaining() int {
+	return t.remaining
+}
+
+// Name returns the name of downloaded archives, if the uploader gave one
+func (t *Transfer) Name() string {
+	return t.Manifest.Name
+}
+
+// Format returns the extension of the format chosen by the uploader, if any
+func (t *Transfer) Format() string {
+	return t.Manifest.Format
+}
+
+// Multiple reports whether the transfer consists of more than a single file
+func (t *Transfer) Multiple() bool {
+	return len(t.Entries) > 1 || (len(t.Entries) == 1 && t.Entries[0].Mode.IsDir())
+}
+
+// Recipient returns the public key downloads must be encrypted to, if any
+func (t *Transfer) Recipient() string {
+	return t.Manifest.Recipient
+}
+
+// Protected reports whether downloaders must know a password
+func (t *Transfer) Protected() bool {
+	return t.Password != nil
+}
+
+// Authenticate reports whether password is the download password
+func (t *Transfer) Authenticate(password string) bool {
+	return t.Password == nil || bcrypt.CompareHashAndPassword(t.Password, []byte(password)) == nil
+}
+
+// PackTo packs the stored files with p, counting the download if it succeeds
+func (t *Transfer) PackTo(p packer.PackerCloser) error {
+	// the transfer is kept until its files have been read
+	err := t.spool.open(t.ID)
+	if err == nil {
+		err = t.pack(p, func(e Entry) (io.ReadCloser, error) { return t.spool.Store.Get(e.Object, 0) })
+		t.spool.close(t.ID)
+	}
+	if err == nil {
+		err = p.Close()
+	} else {
+		_ = p.Close()
+	}
+
+	if t.taken {
+		t.spool.release(t.ID, err == nil)
+	}
+
+	return err
+}
+
+// Cancel gives up a download claimed by Take, without counting it
+func (t *Transfer) Cancel(reason string) {
+	if t.taken {
+		t.taken = false
+		t.spool.release(t.ID, false)
+	}
+}
+
+// Archive lays out the transfer in a predictable format, allowing the
+// archive to be served with a known size and random access
+//
+// Reading the archive does not count as a download until it is claimed, the
+// download is then counted once every byte of the archive has been read by
+// archives of the same claim. The transfer is kept until every archive of it
+// is closed
+func (t *Transfer) Archive(extension string) (packer.Archive, error) {
+	format, exists := packer.Lookup(extension)
+	if !exists || !format.Predictable {
+		return nil, fmt.Errorf("%s archives cannot be laid out", extension)
+	}
+
+	layout := &packer.Layout{}
+	p, err := format.New(layout)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.pack(p, func(e Entry) (io.ReadCloser, error) {
+		return io.NopCloser(layout.Contents(e.Object, e.Size)), nil
+	})
+	if err == nil {
+		err = p.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to lay out %s: %w", t.ID, err)
+	}
+
+	err = t.spool.open(t.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &archive{
+		ReadSeekCloser: layout.Reader(t.spool.Store.Get),
+		transfer:       t,
+		size:           layout.Size,
+		etag:           fmt.Sprintf(`"%s-%s-%x"`, t.ID, extension, t.Created.UnixNano()),
+	}, nil
+}
+
+// pack replays the entries of the manifest, with file contents from contents
+func (t *Transfer) pack(p packer.Packer, contents func(Entry) (io.ReadCloser, error)) error {
+	cwd := "."
+	for _, e := range t.Entries {
+		// leave directories until we are in the parent of this entry
+		for cwd != path.Dir(e.Path) {
+			if cwd == "." {
+				return fmt.Errorf("manifest of %s is out of order at %s", t.ID, e.Path)
+			}
+
+			err := p.Exit()
+			if err != nil {
+				return err
+			}
+			cwd = path.Dir(cwd)
+		}
+
+		// archives must come out the same every time, fall back to when the
+		// transfer was stored rather than the current time
+		if ts, ok := p.(packer.Timestamper); ok {
+			if e.Modified.IsZero() {
+				ts.Times(t.Created, time.Time{})
+			} else {
+				ts.Times(e.Modified, e.Accessed)
+			}
+		}
+
+		if e.Mode.IsDir() {
+			err := p.Enter(path.Base(e.Path), e.Mode&^os.ModeDir)
+			if err != nil {
+				return err
+			}
+			cwd = e.Path
+			continue
+		}
+
+		if c, ok := p.(packer.Checksummer); ok {
+			c.Checksum(e.CRC32)
+		}
+
+		r, err := contents(e)
+		if err != nil {
+			return fmt.Errorf("unable to get %s: %w", e.Path, err)
+		}
+
+		err = p.File(path.Base(e.Path), e.Mode, e.Size, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	for ; cwd != "."; cwd = path.Dir(cwd) {
+		err := p.Exit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// archive is a laid out transfer, it implements packer.Archive
+type archive struct {
+	io.ReadSeekCloser
+	transfer *Transfer
+	size     int64
+	etag     string
+
+	// claim is the download served by the archive, if claimed
+	claim *claim
+
+	// completed is set once the whole archive have been served to the claim
+	completed bool
+}
+
+// Claim claims a download of the archive, or resumes the download claimed
+// by an earlier archive if etag is its ETag. The ETag of a claimed archive
+// identifies the claim, clients resuming the download give it back with If-Range.
+func (a *archive) Claim(etag string) error {
+	// claims are told apart by a random token, it must not be guessed by others
+	prefix := strings.TrimSuffix(a.etag, `"`) + "-"
+	if !strings.HasPrefix(etag, prefix) || !strings.HasSuffix(etag, `"`) {
+		etag = prefix + rand.Text() + `"`
+	}
+
+	c, err := a.transfer.spool.claim(etag, a.transfer.ID, a.size)
+	if err != nil {
+		return err
+	}
+
+	a.claim = c
+	return nil
+}
+
+func (a *archive) Read(p []byte) (int, error) {
+	offset, _ := a.ReadSeekCloser.Seek(0, io.SeekCurrent)
+	n, err := a.ReadSeekCloser.Read(p)
+
+	if n > 0 && a.claim != nil && a.transfer.spool.cover(a.claim, offset, offset+int64(n)) {
+		a.completed = true
+	}
+
+	return n, err
+}
+
+// ETag identifies the archive, or the claim once claimed
+func (a *archive) ETag() string {
+	if a.claim != nil {
+		return a.claim.key
+	}
+	return a.etag
+}
+
+func (a *archive) ModTime() time.Time {
+	return a.transfer.Created
+}
+
+// Remaining returns how many downloads remain after this one
+func (a *archive) Remaining() int {
+	if a.claim != nil {
+		return a.claim.transfer.remaining
+	}
+	return a.transfer.remaining
+}
+
+// Close counts the claimed download if this archive completed it
+func (a *archive) Close() error {
+	err := a.ReadSeekCloser.Close()
+	a.transfer.spool.close(a.transfer.ID)
+
+	if a.claim != nil {
+		s := a.transfer.spool
+		s.mu.Lock()
+		a.claim.readers--
+		s.mu.Unlock()
+	}
+
+	if a.completed {
+		a.transfer.spool.release(a.transfer.ID, true)
+	}
+
+	return err
+}
@@ -0,0 +1,377 @@
+package spool
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fasmide/schttp/packer"
+	"github.com/fasmide/schttp/storage"
+)
+
+// flakyStore fails every Get and Put while failing is set, as a backend having a
+// hiccup, and delays every Get by delay nanoseconds, as a backend far away
+type flakyStore struct {
+	storage.Store
+	failing atomic.Bool
+	delay   atomic.Int64
+}
+
+var errFlaky = errors.New("backend hiccup")
+
+func (f *flakyStore) Get(key string, offset int64) (io.ReadCloser, error) {
+	time.Sleep(time.Duration(f.delay.Load()))
+	if f.failing.Load() {
+		return nil, errFlaky
+	}
+	return f.Store.Get(key, offset)
+}
+
+func (f *flakyStore) Put(key string, r io.Reader, size int64) error {
+	if f.failing.Load() {
+		return errFlaky
+	}
+	return f.Store.Put(key, r, size)
+}
+
+// newSpool returns a spool stored in a temporary directory
+func newSpool(t *testing.T, maxSize int64) (*Spool, *flakyStore) {
+	dir, err := storage.NewDir(t.TempDir())
+	if err != nil {
+		t.Fatalf("unable to create store: %s", err)
+	}
+
+	store := &flakyStore{Store: dir}
+	s, err := New(store, time.Hour, maxSize)
+	if err != nil {
+		t.Fatalf("unable to create spool: %s", err)
+	}
+	return s, store
+}
+
+// store stores a transfer of a single file
+func store(t *testing.T, s *Spool, id string, o Options, contents string) {
+	w, err := s.Create(id, o)
+	if err != nil {
+		t.Fatalf("unable to create %s: %s", id, err)
+	}
+
+	err = w.File("file.txt", 0644, int64(len(contents)), strings.NewReader(contents))
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		t.Fatalf("unable to store %s: %s", id, err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	s, flaky := newSpool(t, 0)
+
+	store(t, s, "kept", Options{}, "hello")
+	store(t, s, "expired", Options{TTL: time.Millisecond}, "hello")
+	time.Sleep(10 * time.Millisecond)
+
+	// transfers are not removed while the store fails to read them
+	flaky.failing.Store(true)
+	s.Expire()
+	flaky.failing.Store(false)
+
+	for _, id := range []string{"kept", "expired"} {
+		objects, err := s.Store.List(id + "/")
+		if err != nil || len(objects) == 0 {
+			t.Fatalf("%s removed while the store failed: %v", id, err)
+		}
+	}
+
+	_, err := s.Stat("expired")
+	if !errors.Is(err, ErrExpired) {
+		t.Fatalf("expected ErrExpired, got %v", err)
+	}
+
+	s.Expire()
+
+	_, err = s.Stat("kept")
+	if err != nil {
+		t.Fatalf("transfer which have not expired was removed: %s", err)
+	}
+
+	objects, err := s.Store.List("expired/")
+	if err != nil || len(objects) != 0 {
+		t.Fatalf("expired transfer was not removed: %v %v", objects, err)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	s, flaky := newSpool(t, 1000)
+	contents := strings.Repeat("x", 400)
+
+	// space reserved for files which failed to be stored is released
+	flaky.failing.Store(true)
+	for range 3 {
+		w, err := s.Create("failing", Options{})
+		if err != nil {
+			t.Fatalf("unable to create transfer: %s", err)
+		}
+
+		err = w.File("file.txt", 0644, int64(len(contents)), strings.NewReader(contents))
+		if !errors.Is(err, errFlaky) {
+			t.Fatalf("expected the store to fail, got %v", err)
+		}
+	}
+	flaky.failing.Store(false)
+
+	if s.used != 0 {
+		t.Fatalf("%d bytes still reserved after failing to store", s.used)
+	}
+
+	store(t, s, "stored", Options{}, contents)
+}
+
+func TestSegments(t *testing.T) {
+	s, _ := newSpool(t, 0)
+	store(t, s, "segmented", Options{}, strings.Repeat("x", 10000))
+
+	transfer, err := s.Stat("segmented")
+	if err != nil {
+		t.Fatalf("unable to stat transfer: %s", err)
+	}
+
+	// a download manager reads the archive in two segments at once
+	first := claimed(t, transfer, "")
+	second := claimed(t, transfer, first.ETag())
+
+	size, _ := first.Seek(0, io.SeekEnd)
+	_, _ = first.Seek(size/2, io.SeekStart)
+	b, err := io.ReadAll(io.LimitReader(first, 512))
+	if err != nil || len(b) != 512 {
+		t.Fatalf("unable to read second half: %v", err)
+	}
+
+	// the other segment reads the rest, completing the download while the first is still being read
+	_, err = io.ReadAll(second)
+	if err != nil {
+		t.Fatalf("unable to read the rest: %s", err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		second.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+		t.Fatalf("transfer removed while another segment was being read")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	_, err = io.ReadAll(first)
+	if err != nil {
+		t.Fatalf("unable to read the rest of the second half: %s", err)
+	}
+
+	first.Close()
+	<-closed
+
+	_, err = s.Stat("segmented")
+	if err == nil {
+		t.Fatalf("transfer still available after download")
+	}
+}
+
+// claimed returns an archive of transfer, resuming the claim of etag if given
+func claimed(t *testing.T, transfer *Transfer, etag string) packer.Archive {
+	a, err := transfer.Archive("tar")
+	if err != nil {
+		t.Fatalf("unable to lay out archive: %s", err)
+	}
+
+	err = a.(*archive).Claim(etag)
+	if err != nil {
+		t.Fatalf("unable to claim %s with %s: %s", transfer.ID, etag, err)
+	}
+	return a
+}
+
+// serve reads length bytes from offset of an archive claimed with etag, and
+// returns the ETag of the claim
+func serve(t *testing.T, transfer *Transfer, etag string, offset, length int64) string {
+	a := claimed(t, transfer, etag)
+	defer a.Close()
+
+	_, _ = a.Seek(offset, io.SeekStart)
+	_, err := io.Copy(io.Discard, io.LimitReader(a, length))
+	if err != nil {
+		t.Fatalf("unable to read %d bytes at %d: %s", length, offset, err)
+	}
+	return a.ETag()
+}
+
+func TestCoverage(t *testing.T) {
+	s, _ := newSpool(t, 0)
+	store(t, s, "ranged", Options{Downloads: 2}, strings.Repeat("x", 10000))
+
+	transfer, err := s.Stat("ranged")
+	if err != nil {
+		t.Fatalf("unable to stat transfer: %s", err)
+	}
+	a, _ := transfer.Archive("tar")
+	size, _ := a.Seek(0, io.SeekEnd)
+	a.Close()
+
+	downloaded := func() int {
+		transfer, err := s.Stat("ranged")
+		if err != nil {
+			return -1
+		}
+		return transfer.Downloaded
+	}
+
+	// the end of the archive alone is not a download, nor is most of it
+	serve(t, transfer, "", size-1, 1)
+	most := serve(t, transfer, "", 0, size-1024)
+	if downloaded() != 0 {
+		t.Fatalf("partly served archives counted as downloads")
+	}
+
+	// claims are only resumed by their own ETag, no one else is able to use them
+	a, _ = transfer.Archive("tar")
+	if a.(*archive).Claim("") == nil || a.(*archive).Claim(a.ETag()) == nil {
+		t.Fatalf("a third download claimed while two were in progress")
+	}
+	a.Close()
+
+	// every byte, in any order, is
+	serve(t, transfer, most, size-1024, 1024)
+	if downloaded() != 1 {
+		t.Fatalf("archive served in ranges was not counted: %d", downloaded())
+	}
+
+	// unfinished downloads count against the transfer until they are given up
+	_, err = s.Take("ranged")
+	if err == nil {
+		t.Fatalf("transfer taken while its last download was claimed")
+	}
+
+	s.Idle = 0
+	s.Expire()
+
+	serve(t, transfer, "", 0, size)
+	if downloaded() != -1 {
+		t.Fatalf("transfer still available after its last download")
+	}
+}
+
+func TestTakeRace(t *testing.T) {
+	s, slow := newSpool(t, 0)
+	tar, _ := packer.Lookup("tar")
+
+	for i := range 5 {
+		id := fmt.Sprintf("once%d", i)
+		store(t, s, id, Options{}, "hello")
+
+		transfer, err := s.Take(id)
+		if err != nil {
+			t.Fatalf("unable to take %s: %s", id, err)
+		}
+
+		// others try to take the transfer while its only download completes
+		var taken atomic.Int64
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+
+					if _, err := s.Take(id); err == nil {
+						taken.Add(1)
+					}
+				}
+			}()
+		}
+
+		// reading the manifest takes long enough for the others to be in the middle of it
+		slow.delay.Store(int64(5 * time.Millisecond))
+		p, _ := tar.New(io.Discard)
+		err = transfer.PackTo(p)
+		slow.delay.Store(0)
+		if err != nil {
+			t.Fatalf("unable to download %s: %s", id, err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		close(done)
+		wg.Wait()
+
+		if taken.Load() != 0 {
+			t.Fatalf("%s taken %d more times after its only download", id, taken.Load())
+		}
+	}
+}
+
+// pausingPacker tells when it is about to read the first file, and waits for proceed
+type pausingPacker struct {
+	packer.PackerCloser
+	started, proceed chan struct{}
+}
+
+func (p *pausingPacker) File(name string, mode os.FileMode, size int64, r io.Reader) error {
+	close(p.started)
+	<-p.proceed
+	return p.PackerCloser.File(name, mode, size, r)
+}
+
+func TestStreamed(t *testing.T) {
+	s, _ := newSpool(t, 0)
+	store(t, s, "streamed", Options{}, "hello")
+
+	transfer, err := s.Take("streamed")
+	if err != nil {
+		t.Fatalf("unable to take transfer: %s", err)
+	}
+
+	tar, _ := packer.Lookup("tar")
+	var b bytes.Buffer
+	tw, _ := tar.New(&b)
+	p := &pausingPacker{PackerCloser: tw, started: make(chan struct{}), proceed: make(chan struct{})}
+
+	packed := make(chan error)
+	go func() { packed <- transfer.PackTo(p) }()
+	<-p.started
+
+	// the transfer is removed while it is being streamed
+	removed := make(chan error)
+	go func() { removed <- s.remove("streamed") }()
+
+	select {
+	case <-removed:
+		t.Fatalf("transfer removed while being streamed")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(p.proceed)
+	err = <-packed
+	if err != nil || !bytes.Contains(b.Bytes(), []byte("hello")) {
+		t.Fatalf("unable to stream transfer while it was removed: %v", err)
+	}
+
+	err = <-removed
+	if err != nil {
+		t.Fatalf("unable to remove transfer: %s", err)
+	}
+}
@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Dir stores objects as files in a local directory
+type Dir struct {
+	Path string
+}
+
+// NewDir returns a *Dir storing objects in directory, creating it if needed
+func NewDir(directory string) (*Dir, error) {
+	err := os.MkdirAll(directory, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create storage directory: %w", err)
+	}
+
+	return &Dir{Path: directory}, nil
+}
+
+// file returns the filename of key, keys must not be able to escape the directory
+func (d *Dir) file(key string) (string, error) {
+	if key == "" || path.IsAbs(key) || strings.Contains(key, `\`) || path.Clean(key) != key || strings.HasPrefix(key, "..") {
+		return "", fmt.Errorf("invalid key %q", key)
+	}
+
+	return filepath.Join(d.Path, filepath.FromSlash(key)), nil
+}
+
+func (d *Dir) Put(key string, r io.Reader, size int64) error {
+	name, err := d.file(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(name), 0700)
+	if err != nil {
+		return err
+	}
+
+	// objects show up once they are complete
+	fd, err := os.CreateTemp(filepath.Dir(name), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fd.Name())
+
+	_, err = io.CopyN(fd, r, size)
+	if err != nil {
+		fd.Close()
+		return err
+	}
+
+	err = fd.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(fd.Name(), name)
+}
+
+func (d *Dir) Get(key string, offset int64) (io.ReadCloser, error) {
+	name, err := d.file(key)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = fd.Seek(offset, io.SeekStart)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	return fd, nil
+}
+
+func (d *Dir) Delete(key string) error {
+	name, err := d.file(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	// remove directories left empty, stops at the first one which is not
+	for dir := filepath.Dir(name); dir != filepath.Clean(d.Path); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+
+	return nil
+}
+
+func (d *Dir) List(prefix string) ([]Object, error) {
+	var objects []Object
+
+	err := filepath.WalkDir(d.Path, func(name string, e fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".put-") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(d.Path, name)
+		if err != nil {
+			return err
+		}
+
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, Object{Key: key, Size: fi.Size(), Modified: fi.ModTime()})
+		return nil
+	})
+
+	return objects, err
+}
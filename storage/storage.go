@@ -0,0 +1,32 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotExist is returned when an object does not exist
+var ErrNotExist = errors.New("object does not exist")
+
+// Store holds objects by key, keys are slash separated paths
+type Store interface {
+	// Put stores exactly size bytes from r as key
+	Put(key string, r io.Reader, size int64) error
+
+	// Get returns the contents of key starting at offset
+	Get(key string, offset int64) (io.ReadCloser, error)
+
+	// Delete removes key, deleting keys which does not exist is not an error
+	Delete(key string) error
+
+	// List returns every object with keys starting with prefix
+	List(prefix string) ([]Object, error)
+}
+
+// Object describes a stored object
+type Object struct {
+	Key      string
+	Size     int64
+	Modified time.Time
+}
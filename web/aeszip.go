@@ -0,0 +1,53 @@
+package web
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/fasmide/schttp/packer"
+)
+
+// sinkAESZip serves a password protected sink as a zip file encrypted with
+// its password, which the downloader have already given
+func (s *Server) sinkAESZip(w http.ResponseWriter, r *http.Request, id string, always bool) {
+	peeked, err := s.DB.Peek(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if g, ok := peeked.(guarded); !ok || !g.Protected() {
+		http.Error(w, fmt.Sprintf("%s have no password to encrypt with - please use .zip", id), http.StatusBadRequest)
+		return
+	}
+
+	if s.preflight(w, r, id, "application/zip") {
+		return
+	}
+
+	// authorized have checked the password already, sessions do not know it
+	p, given := password(r)
+	if !given {
+		w.Header().Set("WWW-Authenticate", `Basic realm="schttp", charset="UTF-8"`)
+		http.Error(w, "the password is needed to encrypt with - e.g. curl -u :password", http.StatusUnauthorized)
+		return
+	}
+
+	sink, err := s.DB.Sink(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	log.Printf("%s sinks %s", r.RemoteAddr, r.URL.Path)
+	announce(sink, r, packer.AESZipExtension)
+	remaining(w, sink)
+	attachment(w, sink, id, "zip", always)
+	w.Header().Set("Content-Type", "application/zip")
+
+	err = sink.PackTo(packer.NewAESZip(metered(sink, w), p))
+	if err != nil {
+		log.Printf("HTTP: failed to sink encrypted zip to %s: %s", r.RemoteAddr, err)
+	}
+}
@@ -0,0 +1,253 @@
+package web
+
+import (
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fasmide/schttp/packer"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	// format served to clients not asking for anything in particular, e.g. plain curl
+	viper.SetDefault("DEFAULT_FORMAT", "tar.gz")
+}
+
+// connector is implemented by sinks knowing if their uploader is still connected
+type connector interface {
+	Connected() bool
+}
+
+// expirer is implemented by sinks which expire
+type expirer interface {
+	Expiry() time.Time
+}
+
+// namer is implemented by sinks which the uploader have named
+type namer interface {
+	Name() string
+}
+
+// formatter is implemented by sinks which the uploader have picked a format for
+type formatter interface {
+	Format() string
+}
+
+// storer is implemented by sinks stored on the server, these do not depend on the uploader
+type storer interface {
+	Stored() bool
+}
+
+var landingTemplate = template.Must(template.New("landing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Download {{.ID}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; padding: 0 1em; }
+pre { background: #eee; padding: .5em; overflow-x: auto; }
+form { display: inline; }
+</style>
+</head>
+<body>
+<h1>Download {{.ID}}</h1>
+{{if .Stored}}
+<p>The files are stored on the server and waiting for you.</p>
+{{else if .Connected}}
+<p>The uploader is connected and waiting for you.</p>
+{{else}}
+<p><strong>The uploader have disconnected - the download will most likely fail.</strong></p>
+{{end}}
+<p>{{if gt .Downloads 1}}This link works {{.Downloads}} more times{{else}}This link only works once{{end}}{{if not .Expires.IsZero}}, until {{.Expires.UTC.Format "2006-01-02 15:04 MST"}}{{end}}. Pick a format:</p>
+<p>
+{{range .Formats}}<form method="post" action="{{.URL}}">{{if .Password}}<input type="password" name="password" placeholder="password" required> {{end}}<button type="submit">.{{.Extension}}</button></form>
+{{end}}</p>
+
+{{if .Protected}}
+<p>The commands below need the password in place of PASSWORD, any username will do.</p>
+{{end}}
+{{if .Encrypted}}
+<p>The files are encrypted with <a href="https://age-encryption.org">age</a>, only the recipient is able to decrypt them:</p>
+<pre>curl{{if .Protected}} -u :PASSWORD{{end}} {{.URL}}.tar.gz.age | age -d -i ~/.ssh/id_ed25519 | tar xvz</pre>
+{{else}}
+<h2>curl</h2>
+<pre>curl{{if .Protected}} -u :PASSWORD{{end}} -o {{.ID}}.zip {{.URL}}.zip</pre>
+<p>Or unpack directly (may overwrite existing files):</p>
+<pre>curl{{if .Protected}} -u :PASSWORD{{end}} {{.URL}}.tar.gz | tar xvz</pre>
+
+<h2>wget</h2>
+<pre>wget{{if .Protected}} --user=download --password=PASSWORD{{end}} -O {{.ID}}.tar.gz {{.URL}}.tar.gz</pre>
+
+<h2>PowerShell</h2>
+<pre>Invoke-WebRequest{{if .Protected}} -Credential (Get-Credential){{end}} -Uri {{.URL}}.zip -OutFile {{.ID}}.zip; Expand-Archive {{.ID}}.zip</pre>
+{{end}}
+</body>
+</html>
+`))
+
+// landingFormat is a format as shown on the landing page
+type landingFormat struct {
+	Extension string
+	URL       string
+
+	// Password is set for formats encrypted with the password, which must be given again
+	Password bool
+}
+
+// downloads returns how many times sink may be downloaded from now on
+func downloads(sink packer.PackerTo) int {
+	if c, ok := sink.(counter); ok {
+		return c.Remaining() + 1
+	}
+	return 1
+}
+
+// landing shows a page with download options for a sink, without consuming it
+func (s *Server) landing(w http.ResponseWriter, r *http.Request, id string) {
+	sink, err := s.DB.Peek(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	connected := true
+	if c, ok := sink.(connector); ok {
+		connected = c.Connected()
+	}
+
+	stored := false
+	if st, ok := sink.(storer); ok {
+		stored = st.Stored()
+	}
+
+	var expires time.Time
+	if e, ok := sink.(expirer); ok {
+		expires = e.Expiry()
+	}
+
+	url := fmt.Sprintf("%ssink/%s", viper.GetString("ADVERTISE_URL"), id)
+
+	formats := packer.Formats()
+	data := struct {
+		ID        string
+		URL       string
+		Connected bool
+		Stored    bool
+		Downloads int
+		Expires   time.Time
+		Encrypted bool
+		Protected bool
+		Formats   []landingFormat
+	}{ID: id, URL: url, Connected: connected, Stored: stored, Downloads: downloads(sink), Expires: expires, Encrypted: recipient(sink) != ""}
+
+	// the password is known to protected sinks, which makes encrypted zip files possible
+	if g, ok := sink.(guarded); ok && g.Protected() {
+		data.Protected = true
+		if !data.Encrypted {
+			formats = append(formats, packer.Format{Extension: packer.AESZipExtension})
+		}
+	}
+
+	for _, f := range formats {
+		extension := f.Extension
+		if data.Encrypted {
+			extension += "." + packer.AgeExtension
+		}
+
+		data.Formats = append(data.Formats, landingFormat{
+			Extension: extension,
+			URL:       fmt.Sprintf("%s.%s", url, extension),
+			Password:  f.Extension == packer.AESZipExtension,
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Vary", "Accept")
+
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_ = landingTemplate.Execute(w, data)
+}
+
+// negotiate picks a format from the Accept header, html is true if the client
+// would rather have the landing page. Clients not asking for a format get fallback.
+func negotiate(r *http.Request, fallback packer.Format) (format packer.Format, html bool) {
+	type accept struct {
+		mediaType string
+		q         float64
+	}
+
+	var accepts []accept
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, exists := params["q"]; exists {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		if q <= 0 {
+			continue
+		}
+
+		accepts = append(accepts, accept{mediaType: mediaType, q: q})
+	}
+
+	// most wanted first
+	sort.SliceStable(accepts, func(i, j int) bool { return accepts[i].q > accepts[j].q })
+
+	for _, a := range accepts {
+		if a.mediaType == "text/html" {
+			return packer.Format{}, true
+		}
+
+		for _, f := range packer.Formats() {
+			if f.MIMEType == a.mediaType {
+				return f, false
+			}
+		}
+	}
+
+	// anything else, such as */*, results in the fallback format
+	return fallback, false
+}
+
+// preferred returns the format chosen by the uploader of sink, or the default format
+func preferred(sink packer.PackerTo) packer.Format {
+	if f, ok := sink.(formatter); ok {
+		if format, exists := packer.Lookup(f.Format()); exists {
+			return format
+		}
+	}
+
+	format, exists := packer.Lookup(viper.GetString("DEFAULT_FORMAT"))
+	if !exists {
+		format = packer.Formats()[0]
+	}
+	return format
+}
+
+// filename returns the file name of sink downloaded as extension, and whether
+// the uploader named it
+func filename(sink packer.PackerTo, id, extension string) (string, bool) {
+	if n, ok := sink.(namer); ok && n.Name() != "" {
+		return fmt.Sprintf("%s.%s", n.Name(), extension), true
+	}
+	return fmt.Sprintf("%s.%s", id, extension), false
+}
@@ -0,0 +1,176 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// sessionTTL is how long browsers which gave the password may keep downloading
+const sessionTTL = 15 * time.Minute
+
+// sessionKey signs sessions, they do not outlive the process
+var sessionKey = func() []byte {
+	b := make([]byte, 32)
+	_, _ = rand.Read(b)
+	return b
+}()
+
+// guarded is implemented by sinks which may be protected by a password
+type guarded interface {
+	Protected() bool
+	Authenticate(password string) bool
+}
+
+var passwordTemplate = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Password required</title>
+</head>
+<body>
+{{if .}}<p><strong>Wrong password.</strong></p>{{end}}
+<p>The uploader protected these files with a password.</p>
+<form method="post">
+<input type="password" name="password" autofocus>
+<button type="submit">Continue</button>
+</form>
+</body>
+</html>
+`))
+
+// sinkID returns the id of a sink path, such as id of id.tar.gz or id/filename
+func sinkID(name string) string {
+	if i := strings.IndexAny(name, "./"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// password returns the password given with HTTP Basic auth or a submitted form
+func password(r *http.Request) (string, bool) {
+	if _, p, ok := r.BasicAuth(); ok {
+		return p, true
+	}
+
+	if r.Method == http.MethodPost {
+		if p := r.PostFormValue("password"); p != "" {
+			return p, true
+		}
+	}
+
+	return "", false
+}
+
+// sessionCookie is the name of the cookie holding the session of sink id
+func sessionCookie(id string) string {
+	return "schttp-" + id
+}
+
+// sign returns the signature of a session of sink id, valid until expires
+func sign(id string, expires int64) string {
+	mac := hmac.New(sha256.New, sessionKey)
+	fmt.Fprintf(mac, "%s %d", id, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// startSession lets the browser keep downloading sink id for a while, without
+// having the password passed around in pages
+func startSession(w http.ResponseWriter, id string) {
+	// browsers see sinks where they are advertised, which may be behind a proxy
+	advertised, err := url.Parse(viper.GetString("ADVERTISE_URL"))
+	if err != nil {
+		advertised = &url.URL{Path: "/"}
+	}
+
+	expires := time.Now().Add(sessionTTL).Unix()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie(id),
+		Value:    fmt.Sprintf("%d.%s", expires, sign(id, expires)),
+		Path:     path.Join("/", advertised.Path, "sink") + "/",
+		MaxAge:   int(sessionTTL.Seconds()),
+		Secure:   advertised.Scheme == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// session reports whether r carries a session of sink id which have not expired
+func session(r *http.Request, id string) bool {
+	c, err := r.Cookie(sessionCookie(id))
+	if err != nil {
+		return false
+	}
+
+	e, signature, found := strings.Cut(c.Value, ".")
+	if !found {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(e, 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	return hmac.Equal([]byte(signature), []byte(sign(id, expires)))
+}
+
+// authorized asks for the password of protected sinks, before anything else
+// is done with them. It returns false if the request have been answered.
+func (s *Server) authorized(w http.ResponseWriter, r *http.Request, id string) bool {
+	sink, err := s.DB.Peek(id)
+	if err != nil {
+		// the missing sink is reported later on
+		return true
+	}
+
+	g, ok := sink.(guarded)
+	if !ok || !g.Protected() {
+		return true
+	}
+
+	p, given := password(r)
+	if given && g.Authenticate(p) {
+		// browsers submitting the form carry on with a session
+		if r.Method == http.MethodPost {
+			w.Header().Set("Cache-Control", "no-store")
+			startSession(w, id)
+		}
+		return true
+	}
+
+	if !given && session(r, id) {
+		return true
+	}
+
+	if given {
+		log.Printf("%s gave a wrong password for %s", r.RemoteAddr, id)
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	// browsers get a form, everything else is asked for Basic auth
+	if wantsHTML(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusUnauthorized)
+		_ = passwordTemplate.Execute(w, given)
+		return false
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="schttp", charset="UTF-8"`)
+	http.Error(w, "password required - e.g. curl -u :password", http.StatusUnauthorized)
+	return false
+}
@@ -0,0 +1,142 @@
+package web
+
+import (
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	// when enabled, browsers are shown a page asking them to confirm the download
+	// before the sink is consumed
+	viper.SetDefault("INTERSTITIAL", false)
+}
+
+// unfurlers are tokens in the user agents of services fetching urls to show
+// previews of them in chats and mail clients, they must not consume one time urls
+// - the tokens are specific, browsers of people using the same apps must not match
+var unfurlers = []string{
+	"slackbot-linkexpanding",
+	"slackbot",
+	"slack-imgproxy",
+	"skypeuripreview",
+	"microsoftpreview",
+	"microsoft office existence discovery",
+	"ms-office",
+	"bingpreview",
+	"discordbot",
+	"telegrambot",
+	"whatsapp/",
+	"twitterbot",
+	"facebookexternalhit",
+	"linkedinbot",
+	"mattermost-bot",
+	"rocket.chat+https",
+	"google-pagerenderer",
+	"googleimageproxy",
+	"iframely",
+	"embedly",
+	"applebot",
+	"redditbot",
+	"signal-android",
+	"signal-desktop",
+	"signal-ios",
+}
+
+// isUnfurler reports whether the user agent is known to prefetch urls
+func isUnfurler(userAgent string) bool {
+	userAgent = strings.ToLower(userAgent)
+	for _, u := range unfurlers {
+		if strings.Contains(userAgent, u) {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsHTML reports whether the request comes from a browser
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// worksTemplate tells how many times a link works, given the number of downloads left
+const worksTemplate = `{{define "works"}}{{if gt . 1}}works {{.}} more times{{else}}only works once{{end}}{{end}}`
+
+var previewTemplate = template.Must(template.New("preview").Parse(worksTemplate + `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta property="og:title" content="Files shared with scp.click">
+<meta property="og:description" content="Open the link to download - it {{template "works" .}}">
+<title>Files shared with scp.click</title>
+</head>
+<body>
+<p>Open the link to download - it {{template "works" .}}</p>
+</body>
+</html>
+`))
+
+var interstitialTemplate = template.Must(template.New("interstitial").Parse(worksTemplate + `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex">
+<title>Download {{.Name}}</title>
+</head>
+<body>
+<p>This link {{template "works" .Downloads}}, the download starts when you click the button.</p>
+<form method="post">
+<button type="submit">Download {{.Name}}</button>
+</form>
+</body>
+</html>
+`))
+
+// intercepted reports whether preflight answers r with a page rather than the download
+func intercepted(r *http.Request) bool {
+	interstitial := viper.GetBool("INTERSTITIAL") && wantsHTML(r) && r.Method == http.MethodGet
+	return isUnfurler(r.UserAgent()) || interstitial
+}
+
+// preflight answers requests which must not consume a sink: HEAD requests,
+// link unfurlers and - if enabled - browsers who have yet to confirm the download.
+// It returns true if the request have been answered.
+func (s *Server) preflight(w http.ResponseWriter, r *http.Request, id string, contentType string) bool {
+	unfurler := isUnfurler(r.UserAgent())
+
+	if r.Method != http.MethodHead && !intercepted(r) {
+		return false
+	}
+
+	sink, err := s.DB.Peek(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return true
+	}
+
+	// nothing must be cached, the sink may be gone any moment
+	w.Header().Set("Cache-Control", "no-store")
+
+	switch {
+	case r.Method == http.MethodHead:
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(http.StatusOK)
+
+	case unfurler:
+		log.Printf("%s unfurls %s as %s", r.RemoteAddr, r.URL.Path, r.UserAgent())
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = previewTemplate.Execute(w, downloads(sink))
+
+	default:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_ = interstitialTemplate.Execute(w, struct {
+			Name      string
+			Downloads int
+		}{strings.TrimPrefix(r.URL.Path, "/sink/"), downloads(sink)})
+	}
+
+	return true
+}
@@ -1,20 +1,31 @@
 package web
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"mime"
 	"net"
 	"net/http"
+	"os"
 	"path"
+	"strconv"
 	"strings"
 
 	"github.com/fasmide/schttp/packer"
+	"github.com/fasmide/schttp/scp"
 	"github.com/spf13/viper"
 )
 
 func init() {
 	viper.SetDefault("ADVERTISE_URL", "http://localhost:8080/")
+
+	// where scp clients should connect to fetch sources
+	viper.SetDefault("ADVERTISE_SSH", "localhost:2222")
+
+	// how large multipart uploads of sources may be, as they are spooled to disk
+	viper.SetDefault("MULTIPART_MAX_SIZE", 1<<30)
 }
 
 type Server struct {
@@ -24,13 +35,20 @@ type Server struct {
 	// We will be looking up sinks and sources from the database
 	// of connected sinks and sources
 	DB DB
+
+	// MultipartMaxSize is how large multipart uploads may be, MULTIPART_MAX_SIZE if zero
+	MultipartMaxSize int64
 }
 
 // DB specifies methods to find sinks and sources
 // - these must be thread safe
 type DB interface {
 	Sink(string) (packer.PackerTo, error)
-	Source(string) (io.ReaderFrom, error)
+
+	// Peek returns a sink without consuming it
+	Peek(string) (packer.PackerTo, error)
+
+	Source(string, int64) (string, io.ReaderFrom, error)
 }
 
 func (s *Server) Listen(l net.Listener) {
@@ -46,39 +64,105 @@ func (s *Server) Listen(l net.Listener) {
 }
 
 func (s *Server) Sink(w http.ResponseWriter, r *http.Request) {
-	// figure out id and file extension
-	fileParts := strings.SplitN(path.Base(r.URL.Path), ".", 2)
+	// POST is used by browsers confirming the download
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodPost {
+		http.Error(w, "please use GET", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/sink/")
 
-	// ensure there was an file extension given
-	if len(fileParts) != 2 {
-		http.Error(w, "please add file extension, e.g. .zip or .tar.gz", http.StatusBadRequest)
+	// protected sinks are not touched before the password is given
+	if !s.authorized(w, r, sinkID(name)) {
 		return
 	}
 
+	// /sink/<id>/<filename> serves a single uploaded file as is
+	if i := strings.Index(name, "/"); i >= 0 {
+		s.sinkRaw(w, r, name[:i])
+		return
+	}
+
+	// figure out id and file extension
+	fileParts := strings.SplitN(name, ".", 2)
+
+	// without an extension, browsers get a landing page while
+	// everything else gets a format based on the Accept header
+	// - or the format chosen by the uploader
+	explicit := len(fileParts) == 2
+	if !explicit {
+		sink, err := s.DB.Peek(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		format, html := negotiate(r, preferred(sink))
+		if html {
+			s.landing(w, r, name)
+			return
+		}
+
+		w.Header().Set("Vary", "Accept")
+		fileParts = []string{name, format.Extension}
+		if recipient(sink) != "" {
+			fileParts[1] += "." + packer.AgeExtension
+		}
+	}
+
 	// the real id is the first part of ext
 	id := fileParts[0]
 	extension := fileParts[1]
 
-	// figure out a packer to use
-	var p packer.PackerCloser
-	if extension == "zip" {
-		p = packer.NewZip(w)
+	// encrypted sinks are only served through age, e.g. /sink/<id>.tar.gz.age
+	encrypted := strings.HasSuffix(extension, "."+packer.AgeExtension)
+	extension = strings.TrimSuffix(extension, "."+packer.AgeExtension)
+	if !s.encryption(w, id, encrypted) {
+		return
 	}
-	if extension == "tar.gz" {
-		p = packer.NewTarGz(w)
+
+	// /sink/<id>.raw is the same as /sink/<id>/<filename>
+	if extension == "raw" {
+		if encrypted {
+			http.Error(w, "encrypted transfers are only available as archives", http.StatusBadRequest)
+			return
+		}
+		s.sinkRaw(w, r, id)
+		return
+	}
+
+	// protected sinks may be encrypted with their password
+	if extension == packer.AESZipExtension && !encrypted {
+		s.sinkAESZip(w, r, id, !explicit)
+		return
 	}
 
-	// if the above did not result in a packer - stop
-	if p == nil {
+	// figure out a packer to use
+	format, exists := packer.Lookup(extension)
+	if !exists {
 		http.Error(
 			w,
-			fmt.Sprintf("i cannot do \"%s\" files - please add .zip or .tar.gz only", extension),
+			fmt.Sprintf("i cannot do \"%s\" files - please add %s only", extension, packer.Extensions()),
 			http.StatusBadRequest,
 		)
 
 		return
 	}
 
+	contentType := format.MIMEType
+	if encrypted {
+		contentType = packer.AgeMIMEType
+	}
+
+	// stored transfers may be served with a known length and random access
+	if !encrypted && !intercepted(r) && s.sinkStored(w, r, id, format, !explicit) {
+		return
+	}
+
+	if s.preflight(w, r, id, contentType) {
+		return
+	}
+
 	// find the sink in question
 	sink, err := s.DB.Sink(id)
 	if err != nil {
@@ -88,6 +172,24 @@ func (s *Server) Sink(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("%s sinks %s", r.RemoteAddr, r.URL.Path)
+	announce(sink, r, fileParts[1])
+	remaining(w, sink)
+	attachment(w, sink, id, fileParts[1], !explicit)
+
+	var p packer.PackerCloser
+	if encrypted {
+		p, err = packer.NewEncrypted(format, metered(sink, w), recipient(sink))
+	} else {
+		p, err = format.New(metered(sink, w))
+	}
+	if err != nil {
+		log.Printf("HTTP: unable to create %s packer: %s", format.Extension, err)
+		cancel(sink, fmt.Sprintf("unable to create %s packer", format.Extension))
+		http.Error(w, "unable to create packer", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
 
 	// Pack sink contents to packer
 	err = sink.PackTo(p)
@@ -97,6 +199,330 @@ func (s *Server) Sink(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// canceller is implemented by sinks which must be told when they will not be packed after all
+type canceller interface {
+	Cancel(reason string)
+}
+
+// cancel tells sink it will not be packed after all, e.g. so the uploader is not left waiting
+func cancel(sink packer.PackerTo, reason string) {
+	if c, ok := sink.(canceller); ok {
+		c.Cancel(reason)
+	}
+}
+
+// counter is implemented by sinks which may be downloaded more than once
+type counter interface {
+	Remaining() int
+}
+
+// remaining reports how many downloads of sink remain after this one
+func remaining(w http.ResponseWriter, sink packer.PackerTo) {
+	if c, ok := sink.(counter); ok {
+		w.Header().Set("X-Downloads-Remaining", strconv.Itoa(c.Remaining()))
+	}
+}
+
+// attachment sets the file name of the download if the uploader named the sink,
+// or always if the url does not tell it
+func attachment(w http.ResponseWriter, sink packer.PackerTo, id, extension string, always bool) {
+	name, named := filename(sink, id, extension)
+	if !named && !always {
+		return
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+}
+
+// announcer is implemented by sinks able to tell the uploader about downloaders
+type announcer interface {
+	Announce(remote, userAgent, format string)
+}
+
+// announce tells the uploader of sink who is downloading it, and in which format
+func announce(sink packer.PackerTo, r *http.Request, format string) {
+	if a, ok := sink.(announcer); ok {
+		a.Announce(r.RemoteAddr, r.UserAgent(), format)
+	}
+}
+
+// meter is implemented by sinks counting the bytes delivered to the downloader
+type meter interface {
+	Meter(w io.Writer) io.Writer
+}
+
+// metered returns w, counting the bytes written to it if sink is able to
+func metered(sink packer.PackerTo, w io.Writer) io.Writer {
+	if m, ok := sink.(meter); ok {
+		return m.Meter(w)
+	}
+	return w
+}
+
+// multipler is implemented by sinks knowing whether they hold more than a single file
+type multipler interface {
+	Multiple() bool
+}
+
+// multiple reports whether sink is known to hold more than a single file
+func multiple(sink packer.PackerTo) bool {
+	m, ok := sink.(multipler)
+	return ok && m.Multiple()
+}
+
+// encrypter is implemented by sinks which must be encrypted to a recipient
+type encrypter interface {
+	Recipient() string
+}
+
+// recipient returns the public key sink must be encrypted to, if any
+func recipient(sink packer.PackerTo) string {
+	if e, ok := sink.(encrypter); ok {
+		return e.Recipient()
+	}
+	return ""
+}
+
+// encryption checks that encrypted sinks are asked for with the age extension
+// and others without. It returns false if the request have been answered.
+func (s *Server) encryption(w http.ResponseWriter, id string, encrypted bool) bool {
+	sink, err := s.DB.Peek(id)
+	if err != nil {
+		// the missing sink is reported later on
+		return true
+	}
+
+	switch {
+	case encrypted && recipient(sink) == "":
+		http.Error(w, fmt.Sprintf("%s is not encrypted - please leave out .%s", id, packer.AgeExtension), http.StatusBadRequest)
+		return false
+
+	case !encrypted && recipient(sink) != "":
+		http.Error(w, fmt.Sprintf("%s is encrypted - please add .%s, e.g. %s.tar.gz.%s", id, packer.AgeExtension, id, packer.AgeExtension), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// sinkRaw streams the single file of an upload without packing it into an archive
+func (s *Server) sinkRaw(w http.ResponseWriter, r *http.Request, id string) {
+	if !s.encryption(w, id, false) {
+		return
+	}
+
+	// uploads known to hold several files are turned down before they are consumed
+	if peeked, err := s.DB.Peek(id); err == nil && multiple(peeked) {
+		http.Error(w, "raw downloads only works with a single file - please pick an archive format", http.StatusConflict)
+		return
+	}
+
+	// the real content type is not known before the sink is consumed
+	if s.preflight(w, r, id, "application/octet-stream") {
+		return
+	}
+
+	sink, err := s.DB.Sink(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	log.Printf("%s sinks %s", r.RemoteAddr, r.URL.Path)
+	announce(sink, r, "raw")
+	remaining(w, sink)
+
+	raw := packer.NewRaw(metered(sink, w), func(name string, _ os.FileMode, size int64) error {
+		contentType := mime.TypeByExtension(path.Ext(name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+		return nil
+	})
+
+	err = sink.PackTo(raw)
+	if err != nil {
+		log.Printf("HTTP: failed to sink raw data to %s: %s", r.RemoteAddr, err)
+
+		// if nothing was written yet, we are still able to tell why
+		if !raw.Written() {
+			http.Error(w, fmt.Sprintf("%s - raw downloads only works with a single file", err), http.StatusConflict)
+		}
+	}
+}
+
+// SourceBanner is sent to the uploader once the source is ready to be fetched
+const SourceBanner = `    -----------------------
+
+    One time id for download
+      %s
+
+    Fetch with scp on another box:
+      scp -r %s .
+    or
+      scp %s .
+
+`
+
 func (s *Server) Source(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		http.Error(w, "please upload with PUT or POST, e.g. curl -T file", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// curl -T appends the filename to the url
+	name := path.Base(r.URL.Path)
+	length := r.ContentLength
+	var body io.Reader = r.Body
+
+	// multipart bodies does not tell the length of the file - so it must be spooled
+	// to disk before we are able to tell the scp client about it
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		limit := s.MultipartMaxSize
+		if limit == 0 {
+			limit = viper.GetInt64("MULTIPART_MAX_SIZE")
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+
+		fd, part, err := spoolMultipart(r)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("multipart uploads are limited to %d bytes - please use curl -T", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer os.Remove(fd.Name())
+		defer fd.Close()
 
+		fi, err := fd.Stat()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		name = part
+		length = fi.Size()
+		body = fd
+	}
+
+	if name == "source" || name == "/" || name == "." {
+		http.Error(w, "please name the file, e.g. /source/somefile.txt", http.StatusBadRequest)
+		return
+	}
+
+	if length < 0 {
+		http.Error(w, "please specify Content-Length", http.StatusLengthRequired)
+		return
+	}
+
+	id, source, err := s.DB.Source(name, length)
+	if errors.Is(err, scp.ErrSourceName) {
+		http.Error(w, fmt.Sprintf("%s - please leave out slashes", err), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// stop waiting for an scp client if the uploader goes away
+	if c, ok := source.(io.Closer); ok {
+		defer c.Close()
+		go func() {
+			<-r.Context().Done()
+			c.Close()
+		}()
+	}
+
+	log.Printf("%s sources %s with id %s", r.RemoteAddr, name, id)
+
+	// the id must reach the uploader while we are still reading its request body
+	rc := http.NewResponseController(w)
+	err = rc.EnableFullDuplex()
+	if err != nil {
+		log.Printf("HTTP: unable to enable full duplex for %s: %s", r.RemoteAddr, err)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, SourceBanner, id, scpTarget(id), scpTarget(path.Join(id, name)))
+	_ = rc.Flush()
+
+	n, err := source.ReadFrom(body)
+	if err != nil {
+		log.Printf("HTTP: failed to source data from %s: %s", r.RemoteAddr, err)
+		fmt.Fprintf(w, "    Transfer failed after %d bytes: %s\n", n, err)
+		return
+	}
+
+	fmt.Fprintf(w, "    Transfered %d bytes\n", n)
+}
+
+// scpTarget formats the scp argument needed to fetch id
+func scpTarget(id string) string {
+	advertised := viper.GetString("ADVERTISE_SSH")
+	host, port, err := net.SplitHostPort(advertised)
+	if err != nil {
+		// no port was given
+		host, port = strings.TrimSuffix(strings.TrimPrefix(advertised, "["), "]"), "22"
+	}
+
+	// scp tells the host from the path by the first colon, unless bracketed
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	if port == "22" {
+		return fmt.Sprintf("%s:%s", host, id)
+	}
+
+	return fmt.Sprintf("-P %s %s:%s", port, host, id)
+}
+
+// spoolMultipart stores the first file of a multipart body in a temporary file
+// and returns it together with its name
+func spoolMultipart(r *http.Request) (*os.File, string, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", err
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, "", fmt.Errorf("no file found in multipart body")
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		// skip regular form fields
+		if part.FileName() == "" {
+			continue
+		}
+
+		fd, err := os.CreateTemp("", "schttp-source-")
+		if err != nil {
+			return nil, "", err
+		}
+
+		_, err = io.Copy(fd, part)
+		if err == nil {
+			_, err = fd.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			fd.Close()
+			os.Remove(fd.Name())
+			return nil, "", err
+		}
+
+		return fd, path.Base(part.FileName()), nil
+	}
 }
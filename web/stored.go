@@ -0,0 +1,77 @@
+package web
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/fasmide/schttp/packer"
+)
+
+// archiver is implemented by stored sinks able to lay out predictable formats
+type archiver interface {
+	Archive(extension string) (packer.Archive, error)
+}
+
+// claimer is implemented by archives counting downloads, a download is claimed
+// and counted once the whole archive have been served to the claim. The ETag of
+// a claimed archive identifies the claim, which is resumed by giving it back.
+type claimer interface {
+	Claim(etag string) error
+}
+
+// sinkStored serves a stored sink with a known length, byte ranges and an ETag,
+// allowing downloads to be resumed. The sink is left in place until every byte
+// of the archive have been served to a download, in as many ranges as it likes
+// - ranges resuming the download give back its ETag with If-Range.
+// It returns false if the sink cannot be served this way.
+func (s *Server) sinkStored(w http.ResponseWriter, r *http.Request, id string, format packer.Format, always bool) bool {
+	if !format.Predictable {
+		return false
+	}
+
+	sink, err := s.DB.Peek(id)
+	if err != nil {
+		return false
+	}
+
+	a, ok := sink.(archiver)
+	if !ok {
+		return false
+	}
+
+	archive, err := a.Archive(format.Extension)
+	if err != nil {
+		log.Printf("HTTP: unable to serve %s with random access: %s", id, err)
+		return false
+	}
+	defer archive.Close()
+
+	if r.Method != http.MethodHead {
+		log.Printf("%s sinks %s (range %q)", r.RemoteAddr, r.URL.Path, r.Header.Get("Range"))
+
+		if c, ok := archive.(claimer); ok {
+			unclaimed := archive.ETag()
+			err = c.Claim(r.Header.Get("If-Range"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return true
+			}
+
+			// the contents are the same whether claimed or not, e.g. the ETag of a HEAD request
+			if r.Header.Get("If-Range") == unclaimed {
+				r.Header.Set("If-Range", archive.ETag())
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", format.MIMEType)
+	w.Header().Set("ETag", archive.ETag())
+	attachment(w, sink, id, format.Extension, always)
+	if c, ok := archive.(counter); ok {
+		w.Header().Set("X-Downloads-Remaining", strconv.Itoa(c.Remaining()))
+	}
+	http.ServeContent(w, r, "", archive.ModTime(), archive)
+
+	return true
+}